@@ -3,9 +3,15 @@ module gitlab.joelpet.se/joelpet/go-rebalance
 go 1.13
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/adrg/xdg v0.2.3
+	github.com/godbus/dbus/v5 v5.1.0 // indirect
 	github.com/imroc/req/v3 v3.42.3
 	github.com/lanl/clp v1.1.0
 	github.com/spf13/cobra v1.1.1
+	github.com/zalando/go-keyring v0.2.1
+	golang.org/x/crypto v0.17.0
 	golang.org/x/term v0.15.0
+	golang.org/x/time v0.5.0
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -2,6 +2,7 @@ package cli
 
 import (
 	"github.com/adrg/xdg"
+	"os"
 	"path/filepath"
 
 	"github.com/spf13/cobra"
@@ -22,6 +23,25 @@ func avanzaMonthlySavingsCacheFile(username string) (string, error) {
 	return xdg.CacheFile(relPath)
 }
 
+// avanzaStateFile returns the path of the named file of the user within the
+// XDG state directory, e.g. to save the session in, creating the directories
+// as needed.
+func avanzaStateFile(username, name string) (string, error) {
+	stateHome := os.Getenv("XDG_STATE_HOME")
+	if stateHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		stateHome = filepath.Join(home, ".local", "state")
+	}
+	dir := filepath.Join(stateHome, "go-rebalance", "avanza", username)
+	if err := os.MkdirAll(dir, os.FileMode(0700)); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name), nil
+}
+
 var (
 	username string
 )
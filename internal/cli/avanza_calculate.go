@@ -20,31 +20,49 @@ var avanzaCalculateCmd = &cobra.Command{
 		if err != nil {
 			log.Fatal(err)
 		}
-		positions = avanza.FilterPositions(positions, accountID)
+		positions = avanza.FilterPositions(positions, accountIDs...)
 
-		monthlySavingsFile, err := avanzaMonthlySavingsCacheFile(username)
-		if err != nil {
-			log.Fatal(err)
-		}
-		distribution, err := avanza.ReadDistribution(monthlySavingsFile, accountID)
-		if err != nil {
-			log.Fatal(err)
+		// The target distribution applies to all accounts together.
+		var distribution []transfers.Distribution
+		var targetOpts []transfers.Option
+		if targetsFile != "" {
+			distribution, targetOpts, err = readTargets(targetsFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+		} else {
+			monthlySavingsFile, err := avanzaMonthlySavingsCacheFile(username)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if len(accountIDs) > 1 {
+				log.Printf("warning: using the monthly savings distribution of account %s for all %d accounts, use --targets to set the targets of them together",
+					accountIDs[0], len(accountIDs))
+			}
+			distribution, err = avanza.ReadDistribution(monthlySavingsFile, accountIDs[0])
+			if err != nil {
+				log.Fatal(err)
+			}
 		}
 
-		transfers.Calculate(positions, distribution)
+		calculate(positions, distribution, targetOpts)
 	},
 }
 
-var (
-	accountID string
-)
+var accountIDs []string
 
 func init() {
 	avanzaCmd.AddCommand(avanzaCalculateCmd)
 
 	avanzaCalculateCmd.
 		Flags().
-		StringVar(&accountID, "account-id", "", "id of the account to calculate rebalancing transfers for")
+		StringArrayVar(&accountIDs, "account-id", nil, "id of the account to calculate rebalancing transfers for; if repeated, the accounts are rebalanced together towards the monthly savings distribution of the first")
 
 	avanzaCalculateCmd.MarkFlagRequired("account-id")
+
+	avanzaCalculateCmd.
+		Flags().
+		StringVar(&targetsFile, "targets", "", "model portfolio file in JSON, YAML or TOML format to use as targets instead of the monthly savings distribution")
+
+	addCalculateFlags(avanzaCalculateCmd)
 }
@@ -2,59 +2,85 @@ package cli
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"time"
 
 	"github.com/spf13/cobra"
 	"gitlab.joelpet.se/joelpet/go-rebalance/pkg/avanza"
-	"golang.org/x/term"
 )
 
 var avanzaFetchCmd = &cobra.Command{
 	Use:   "fetch",
 	Short: "Fetch account data from Avanza through the web API.",
 	Run: func(cmd *cobra.Command, args []string) {
-		var password string
-		if password = os.Getenv("GO_REBALANCE_AVANZA_PASSWORD"); password == "" {
-			fmt.Print("Password [GO_REBALANCE_AVANZA_PASSWORD]: ")
-			if input, err := term.ReadPassword(int(os.Stdin.Fd())); err != nil {
-				log.Fatal(err)
-			} else {
-				password = string(input)
-				fmt.Println()
-			}
+		var opts []avanza.Option
+		if cmd.Flags().Changed("timeout") {
+			opts = append(opts, avanza.WithTimeout(timeout))
+		}
+		if cmd.Flags().Changed("retries") {
+			opts = append(opts, avanza.WithRetries(retries))
+		}
+		if cmd.Flags().Changed("rate-limit") {
+			opts = append(opts, avanza.WithRateLimit(rateLimit))
+		}
+		azaclt, err := avanza.NewClient(opts...)
+		if err != nil {
+			log.Fatal(err)
 		}
 
-		var totp string
-		if totp = os.Getenv("GO_REBALANCE_AVANZA_TOTP"); totp == "" {
-			fmt.Print("TOTP [GO_REBALANCE_AVANZA_TOTP]: ")
-			s := bufio.NewScanner(os.Stdin)
-			if _, err, input := s.Scan(), s.Err(), s.Text(); err != nil {
+		// Cancel the requests on interrupt.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		interrupt := make(chan os.Signal, 1)
+		signal.Notify(interrupt, os.Interrupt)
+		go func() {
+			<-interrupt
+			cancel()
+		}()
+
+		// Reuse the session of an earlier run until it expires.
+		sessionFile, err := avanzaStateFile(username, "session.json")
+		if err != nil {
+			log.Fatal(err)
+		}
+		restored := false
+		if session, err := readAvanzaSession(sessionFile); err != nil {
+			log.Printf("warning: ignoring saved session: %v", err)
+		} else if session != nil && !session.Expired(time.Now()) {
+			if err := azaclt.SetSession(session); err != nil {
 				log.Fatal(err)
-			} else {
-				totp = string(input)
 			}
+			restored = true
+		}
+		if !restored {
+			avanzaLogin(ctx, azaclt)
 		}
 
-		var azaclt *avanza.Client
-		var err error
-		if azaclt, err = avanza.NewClient(); err != nil {
-			log.Fatal(err)
-		} else if err := azaclt.Authenticate(avanza.UserCredentials{
-			Username: username, Password: password, AuthTimeout: 60}); err != nil {
+		monthlySavings, positions, err := avanzaFetch(ctx, azaclt)
+		if errors.Is(err, avanza.ErrUnauthenticated) && restored {
+			log.Print("saved session was rejected, logging in again")
+			avanzaLogin(ctx, azaclt)
+			monthlySavings, positions, err = avanzaFetch(ctx, azaclt)
+		}
+		if err != nil {
 			log.Fatal(err)
-		} else if err := azaclt.TOTP(avanza.TOTP{
-			Method: "TOTP", TOTPCode: totp}); err != nil {
+		}
+
+		if session, err := azaclt.Session(); err != nil {
 			log.Fatal(err)
+		} else if err := writeAvanzaSession(sessionFile, session); err != nil {
+			log.Printf("warning: saving session: %v", err)
 		}
 
 		// Cache monthly savings
-		if monthlySavings, err := azaclt.GetPeriodicSavings(); err != nil {
-			log.Fatal(err)
-		} else if data, err := json.Marshal(monthlySavings); err != nil {
+		if data, err := json.Marshal(monthlySavings); err != nil {
 			log.Fatal(err)
 		} else if f, err := avanzaMonthlySavingsCacheFile(username); err != nil {
 			log.Fatal(err)
@@ -63,9 +89,7 @@ var avanzaFetchCmd = &cobra.Command{
 		}
 
 		// Cache instrument positions
-		if positions, err := azaclt.GetPositions(); err != nil {
-			log.Fatal(err)
-		} else if data, err := json.Marshal(positions); err != nil {
+		if data, err := json.Marshal(positions); err != nil {
 			log.Fatal(err)
 		} else if f, err := avanzaInstrumentPositionsCacheFile(username); err != nil {
 			log.Fatal(err)
@@ -75,6 +99,120 @@ var avanzaFetchCmd = &cobra.Command{
 	},
 }
 
+// avanzaLogin authenticates the client with the password given by an
+// environment variable or on stdin and, if Avanza requires it, a TOTP code
+// given by an environment variable, generated from the secret registered with
+// "avanza totp setup" or given on stdin.
+func avanzaLogin(ctx context.Context, azaclt *avanza.Client) {
+	password, err := readSecret("Password [GO_REBALANCE_AVANZA_PASSWORD]", "GO_REBALANCE_AVANZA_PASSWORD")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	auth, err := azaclt.Authenticate(ctx, avanza.UserCredentials{
+		Username: username, Password: password, AuthTimeout: 60})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch auth.SecondFactor {
+	case avanza.SecondFactorNone:
+	case avanza.SecondFactorTOTP:
+		if err := azaclt.TOTP(ctx, auth, avanzaTOTP()); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("%v: %s, enable two-factor authentication with an authenticator app in Avanza",
+			avanza.ErrUnsupportedMethod, auth.SecondFactor)
+	}
+}
+
+// avanzaTOTP returns the TOTP code given by an environment variable,
+// generated from the registered secret or given on stdin.
+func avanzaTOTP() avanza.TOTP {
+	totp := avanza.TOTP{Method: "TOTP", TOTPCode: os.Getenv("GO_REBALANCE_AVANZA_TOTP")}
+	if totp.TOTPCode != "" {
+		return totp
+	}
+	if secret, err := readAvanzaTOTPSecret(); err != nil {
+		log.Fatal(err)
+	} else if secret != "" {
+		if totp, err = avanza.NewTOTP(secret, time.Now()); err != nil {
+			log.Fatal(err)
+		}
+		return totp
+	}
+
+	fmt.Print("TOTP [GO_REBALANCE_AVANZA_TOTP]: ")
+	s := bufio.NewScanner(os.Stdin)
+	if _, err, input := s.Scan(), s.Err(), s.Text(); err != nil {
+		log.Fatal(err)
+	} else {
+		totp.TOTPCode = input
+	}
+	return totp
+}
+
+// avanzaFetch gets the monthly savings and the instrument positions.
+func avanzaFetch(ctx context.Context, azaclt *avanza.Client) (*avanza.PeriodicSavingsPayload, *avanza.PositionsPayload, error) {
+	monthlySavings, err := azaclt.GetPeriodicSavings(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	positions, err := azaclt.GetPositions(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return monthlySavings, positions, nil
+}
+
+// readAvanzaSession reads a saved session from file, or returns nil if there
+// is none.
+func readAvanzaSession(filename string) (*avanza.Session, error) {
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var session avanza.Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// writeAvanzaSession saves the session to file, readable only by the user as
+// it grants access to the account.
+func writeAvanzaSession(filename string, session *avanza.Session) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filename, data, os.FileMode(0600)); err != nil {
+		return err
+	}
+	return os.Chmod(filename, os.FileMode(0600))
+}
+
+var (
+	timeout   time.Duration
+	retries   int
+	rateLimit time.Duration
+)
+
 func init() {
 	avanzaCmd.AddCommand(avanzaFetchCmd)
+
+	avanzaFetchCmd.
+		Flags().
+		DurationVar(&timeout, "timeout", 30*time.Second, "Time that each attempt of a request may take")
+
+	avanzaFetchCmd.
+		Flags().
+		IntVar(&retries, "retries", 3, "Number of times to retry a request for data after a network error or a response with status 429 or 5xx")
+
+	avanzaFetchCmd.
+		Flags().
+		DurationVar(&rateLimit, "rate-limit", 250*time.Millisecond, "Least time between requests")
 }
@@ -0,0 +1,233 @@
+package cli
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/zalando/go-keyring"
+	"gitlab.joelpet.se/joelpet/go-rebalance/pkg/totp"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+var avanzaTOTPCmd = &cobra.Command{
+	Use:   "totp",
+	Short: "Manage the TOTP secret used for two-factor authentication",
+}
+
+var avanzaTOTPSetupCmd = &cobra.Command{
+	Use:   "setup",
+	Short: "Register the TOTP secret so that codes are generated when logging in",
+	Long: `Register the TOTP secret so that codes are generated when logging in.
+
+The secret is the key that Avanza shows when adding an authenticator app for
+two-factor authentication. It is stored in the keyring of the operating
+system or, if there is none or --encrypted-file is given, in a file encrypted
+with a passphrase, which is read from GO_REBALANCE_AVANZA_TOTP_PASSPHRASE or
+stdin when logging in.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		secret, err := readSecret("TOTP secret [GO_REBALANCE_AVANZA_TOTP_SECRET]", "GO_REBALANCE_AVANZA_TOTP_SECRET")
+		if err != nil {
+			log.Fatal(err)
+		}
+		code, err := totp.Code(secret, time.Now())
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := writeAvanzaTOTPSecret(secret, encryptedFile); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("TOTP secret saved, the current code is %s\n", code)
+	},
+}
+
+// keyringService is the service that secrets are stored under in the keyring.
+const keyringService = "go-rebalance"
+
+// avanzaTOTPSecretFile is the name of the state file of the encrypted secret.
+const avanzaTOTPSecretFile = "totp_secret.json"
+
+// encryptedSecret is a secret encrypted with AES-GCM, by a key derived from a
+// passphrase with scrypt.
+type encryptedSecret struct {
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// secretCipher returns the cipher of the key derived from the passphrase and
+// salt.
+func secretCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptSecret encrypts the secret with the passphrase.
+func encryptSecret(secret, passphrase string) (*encryptedSecret, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := secretCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &encryptedSecret{
+		Salt:       salt,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, []byte(secret), nil),
+	}, nil
+}
+
+// decrypt decrypts the secret with the passphrase.
+func (e *encryptedSecret) decrypt(passphrase string) (string, error) {
+	aead, err := secretCipher(passphrase, e.Salt)
+	if err != nil {
+		return "", err
+	}
+	secret, err := aead.Open(nil, e.Nonce, e.Ciphertext, nil)
+	if err != nil {
+		return "", errors.New("decrypting TOTP secret: wrong passphrase or corrupt file")
+	}
+	return string(secret), nil
+}
+
+// writeAvanzaTOTPSecret stores the TOTP secret of the user in the keyring, or
+// in an encrypted file if toFile is set or the keyring is unavailable, and
+// removes any secret stored in the other place, unless the keyring is
+// unavailable.
+func writeAvanzaTOTPSecret(secret string, toFile bool) error {
+	filename, err := avanzaStateFile(username, avanzaTOTPSecretFile)
+	if err != nil {
+		return err
+	}
+	keyringAvailable := toFile
+	if !toFile {
+		err := keyring.Set(keyringService, "avanza/"+username, secret)
+		if err == nil {
+			if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return nil
+		}
+		log.Printf("warning: keyring unavailable, using an encrypted file instead: %v", err)
+	}
+
+	passphrase, err := readSecret("Passphrase [GO_REBALANCE_AVANZA_TOTP_PASSPHRASE]", "GO_REBALANCE_AVANZA_TOTP_PASSPHRASE")
+	if err != nil {
+		return err
+	}
+	if passphrase == "" {
+		return errors.New("empty passphrase")
+	}
+	if os.Getenv("GO_REBALANCE_AVANZA_TOTP_PASSPHRASE") == "" {
+		if again, err := readSecret("Repeat passphrase", ""); err != nil {
+			return err
+		} else if again != passphrase {
+			return errors.New("passphrases do not match")
+		}
+	}
+	encrypted, err := encryptSecret(secret, passphrase)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(encrypted)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filename, data, os.FileMode(0600)); err != nil {
+		return err
+	}
+	if err := os.Chmod(filename, os.FileMode(0600)); err != nil {
+		return err
+	}
+	if !keyringAvailable {
+		return nil
+	}
+	if err := keyring.Delete(keyringService, "avanza/"+username); err != nil && !errors.Is(err, keyring.ErrNotFound) {
+		return fmt.Errorf("removing TOTP secret from keyring: %w", err)
+	}
+	return nil
+}
+
+// readAvanzaTOTPSecret returns the TOTP secret of the user from the encrypted
+// file or the keyring, or the empty string if none has been stored.
+func readAvanzaTOTPSecret() (string, error) {
+	filename, err := avanzaStateFile(username, avanzaTOTPSecretFile)
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		secret, err := keyring.Get(keyringService, "avanza/"+username)
+		if errors.Is(err, keyring.ErrNotFound) {
+			return "", nil
+		} else if err != nil {
+			return "", fmt.Errorf("reading TOTP secret from keyring: %w", err)
+		}
+		return secret, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	var encrypted encryptedSecret
+	if err := json.Unmarshal(data, &encrypted); err != nil {
+		return "", fmt.Errorf("reading TOTP secret: %s", err)
+	}
+	passphrase, err := readSecret("Passphrase [GO_REBALANCE_AVANZA_TOTP_PASSPHRASE]", "GO_REBALANCE_AVANZA_TOTP_PASSPHRASE")
+	if err != nil {
+		return "", err
+	}
+	return encrypted.decrypt(passphrase)
+}
+
+// readSecret returns the value of the environment variable, if set, or else
+// reads it from the terminal without echo after showing the prompt.
+func readSecret(prompt, env string) (string, error) {
+	if env != "" {
+		if value := os.Getenv(env); value != "" {
+			return value, nil
+		}
+	}
+	fmt.Print(prompt + ": ")
+	input, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	return string(input), nil
+}
+
+var (
+	encryptedFile bool
+)
+
+func init() {
+	avanzaCmd.AddCommand(avanzaTOTPCmd)
+	avanzaTOTPCmd.AddCommand(avanzaTOTPSetupCmd)
+
+	avanzaTOTPSetupCmd.
+		Flags().
+		BoolVar(&encryptedFile, "encrypted-file", false, "Store the secret in an encrypted file instead of the keyring")
+}
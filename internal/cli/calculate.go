@@ -0,0 +1,393 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"gitlab.joelpet.se/joelpet/go-rebalance/pkg/importer"
+	"gitlab.joelpet.se/joelpet/go-rebalance/pkg/transfers"
+)
+
+var calculateCmd = &cobra.Command{
+	Use:   "calculate",
+	Short: "Calculate transfers to rebalance positions from a file towards the targets of a model portfolio file.",
+	Run: func(cmd *cobra.Command, args []string) {
+		positions, err := importer.ReadPositions(positionsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		distribution, targetOpts, err := readTargets(targetsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		calculate(positions, distribution, targetOpts)
+	},
+}
+
+// calculate calculates a plan that rebalances the positions towards the
+// target distribution, with the given options along with those set by flags,
+// and writes it to stdout.
+func calculate(positions []transfers.Position, distribution []transfers.Distribution, targetOpts []transfers.Option) {
+	if types, err := parseAccountTypes(); err != nil {
+		log.Fatal(err)
+	} else {
+		for i, pos := range positions {
+			if accountType, ok := types[pos.Account.ID]; ok {
+				positions[i].Account.Type = accountType
+			}
+		}
+	}
+
+	var objective transfers.Objective
+	switch minimize {
+	case "amount":
+		objective = transfers.MinimizeAmount
+	case "count":
+		objective = transfers.MinimizeCount
+	default:
+		log.Fatalf("unknown objective: %q", minimize)
+	}
+
+	var rebalanceMode transfers.RebalanceMode
+	switch rebalanceTo {
+	case "target":
+		rebalanceMode = transfers.RebalanceToTarget
+	case "edge":
+		rebalanceMode = transfers.RebalanceToEdge
+	default:
+		log.Fatalf("unknown rebalance mode: %q", rebalanceTo)
+	}
+
+	var distMode transfers.DistributionMode
+	switch distributionMode {
+	case "as-is":
+		distMode = transfers.DistributionAsIs
+	case "normalize":
+		distMode = transfers.DistributionNormalize
+	case "strict":
+		distMode = transfers.DistributionStrict
+	default:
+		log.Fatalf("unknown distribution mode: %q", distributionMode)
+	}
+
+	opts := []transfers.Option{
+		transfers.WithObjective(objective),
+		transfers.WithTolerance(tolerance),
+		transfers.WithRebalanceMode(rebalanceMode),
+		transfers.WithDistributionMode(distMode),
+	}
+	opts = append(opts, targetOpts...)
+	switch {
+	case deposit != 0 && withdraw != 0:
+		log.Fatal("cannot both deposit and withdraw")
+	case deposit != 0:
+		opts = append(opts, transfers.WithDeposit(deposit))
+	case withdraw != 0:
+		opts = append(opts, transfers.WithWithdrawal(withdraw))
+	}
+	if allowSwitches {
+		opts = append(opts, transfers.WithSwitches())
+	}
+	if cashTarget != 0 {
+		opts = append(opts, transfers.WithCashTarget(cashTarget))
+	}
+	if constraints, err := parseConstraints(); err != nil {
+		log.Fatal(err)
+	} else if len(constraints) > 0 {
+		opts = append(opts, transfers.WithConstraints(constraints))
+	}
+	if minTransfer > 0 {
+		opts = append(opts, transfers.WithMinTransfer(minTransfer))
+	}
+	if timeLimit > 0 {
+		opts = append(opts, transfers.WithTimeLimit(timeLimit))
+	}
+	if round {
+		opts = append(opts, transfers.WithRounding())
+	}
+	if baseCurrency != "" {
+		rates := transfers.Rates{}
+		if fxRatesFile != "" {
+			f, err := os.Open(fxRatesFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			rates, err = transfers.ReadRates(f)
+			f.Close()
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		opts = append(opts, transfers.WithBaseCurrency(baseCurrency, rates))
+	} else if fxRatesFile != "" {
+		log.Fatal("exchange rates require a base currency")
+	}
+	if transferCostsFile != "" {
+		f, err := os.Open(transferCostsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cost, err := transfers.ReadTransferCosts(f)
+		f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, transfers.WithTransferCost(cost))
+	}
+	if locationCostsFile != "" {
+		f, err := os.Open(locationCostsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cost, err := transfers.ReadLocationCosts(f)
+		f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, transfers.WithLocationCost(cost))
+	}
+
+	plan, err := transfers.Calculate(positions, distribution, opts...)
+	var solverErr *transfers.SolverError
+	if errors.As(err, &solverErr) && dumpModelFile != "" {
+		if err := ioutil.WriteFile(dumpModelFile, []byte(solverErr.Model), os.FileMode(0600)); err != nil {
+			log.Printf("dumping model: %v", err)
+		} else {
+			log.Printf("dumped model to %s", dumpModelFile)
+		}
+	}
+	var report *transfers.ValidationReport
+	if errors.As(err, &report) {
+		for _, problem := range report.Problems {
+			log.Print(problem)
+		}
+		log.Fatal("positions are inconsistent")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(plan.Unmatched) > 0 {
+		log.Printf("warning: instruments not matched between positions and targets: %s", strings.Join(plan.Unmatched, ", "))
+	}
+	for _, problem := range plan.DistributionProblems {
+		log.Printf("warning: target distribution: %v", problem)
+	}
+	if err := transfers.Write(os.Stdout, plan, transfers.Format(output)); err != nil {
+		log.Fatal(err)
+	}
+}
+
+var (
+	positionsFile, targetsFile string
+
+	output   string
+	minimize string
+
+	tolerance   transfers.Tolerance
+	rebalanceTo string
+
+	distributionMode string
+
+	deposit       float64
+	withdraw      float64
+	allowSwitches bool
+
+	cashTarget float64
+
+	minTransfer float64
+	timeLimit   time.Duration
+	round       bool
+
+	transferCostsFile string
+
+	locationCostsFile string
+	accountTypes      []string
+
+	baseCurrency, fxRatesFile string
+
+	dumpModelFile string
+
+	locked, sellOnly, buyOnly []string
+	minWeights, maxWeights    []string
+)
+
+// parseConstraints returns the constraints given by flags per instrument.
+func parseConstraints() (map[string]transfers.Constraint, error) {
+	constraints := map[string]transfers.Constraint{}
+	for _, restrictions := range []struct {
+		instruments []string
+		restriction transfers.Restriction
+	}{
+		{sellOnly, transfers.SellOnly},
+		{buyOnly, transfers.BuyOnly},
+		{locked, transfers.Locked},
+	} {
+		for _, instr := range restrictions.instruments {
+			c := constraints[instr]
+			c.Restriction = restrictions.restriction
+			constraints[instr] = c
+		}
+	}
+
+	for _, weights := range []struct {
+		flags []string
+		set   func(c *transfers.Constraint, weight float64)
+	}{
+		{minWeights, func(c *transfers.Constraint, weight float64) { c.MinWeight = weight }},
+		{maxWeights, func(c *transfers.Constraint, weight float64) { c.MaxWeight = weight }},
+	} {
+		for _, flag := range weights.flags {
+			i := strings.LastIndex(flag, "=")
+			if i < 0 {
+				return nil, fmt.Errorf("invalid weight %q, want instrument=weight", flag)
+			}
+			weight, err := strconv.ParseFloat(flag[i+1:], 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid weight %q: %s", flag, err)
+			}
+			c := constraints[flag[:i]]
+			weights.set(&c, weight)
+			constraints[flag[:i]] = c
+		}
+	}
+	return constraints, nil
+}
+
+// parseAccountTypes returns the types of accounts given by flags per account
+// id.
+func parseAccountTypes() (map[string]string, error) {
+	types := map[string]string{}
+	for _, flag := range accountTypes {
+		i := strings.Index(flag, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid account type %q, want id=type", flag)
+		}
+		types[flag[:i]] = flag[i+1:]
+	}
+	return types, nil
+}
+
+// addCalculateFlags adds the flags that set how plans are calculated and
+// written to cmd.
+func addCalculateFlags(cmd *cobra.Command) {
+	cmd.
+		Flags().
+		StringVarP(&output, "output", "o", string(transfers.FormatText), "output format: text, json, csv or markdown")
+
+	cmd.
+		Flags().
+		StringVar(&minimize, "minimize", "amount", "what to minimize: the total transferred amount or the count of transfers")
+
+	cmd.
+		Flags().
+		Float64Var(&tolerance.Absolute, "tolerance-absolute", 0, "allowed deviation in percentage points of the total value, e.g. 0.02")
+
+	cmd.
+		Flags().
+		Float64Var(&tolerance.Relative, "tolerance-relative", 0, "allowed deviation relative to the target value, e.g. 0.05")
+
+	cmd.
+		Flags().
+		StringVar(&rebalanceTo, "rebalance-to", "target", "how far to rebalance instruments outside their tolerance bands: target or edge")
+
+	cmd.
+		Flags().
+		StringVar(&distributionMode, "distribution-mode", "as-is", "how to handle duplicate, negative or not fully summing targets: as-is, normalize or strict")
+
+	cmd.
+		Flags().
+		Float64Var(&deposit, "deposit", 0, "amount of money to invest while rebalancing")
+
+	cmd.
+		Flags().
+		Float64Var(&withdraw, "withdraw", 0, "amount of money to withdraw while rebalancing")
+
+	cmd.
+		Flags().
+		BoolVar(&allowSwitches, "allow-switches", false, "allow switches between instruments when depositing or withdrawing to reach the targets")
+
+	cmd.
+		Flags().
+		Float64Var(&cashTarget, "cash-target", 0, "target distribution of cash, e.g. 0.05; cash is fully invested by default")
+
+	cmd.
+		Flags().
+		Float64Var(&minTransfer, "min-transfer", 0, "smallest amount of money to transfer at once, e.g. 100")
+
+	cmd.
+		Flags().
+		DurationVar(&timeLimit, "time-limit", 0, "longest time to look for the fewest transfers, or the closest ones of at least --min-transfer, e.g. 10s; 2s by default")
+
+	cmd.
+		Flags().
+		BoolVar(&round, "round", false, "round transferred amounts to the precision of the positions")
+
+	cmd.
+		Flags().
+		StringVar(&transferCostsFile, "transfer-costs", "", "CSV file with the cost per amount transferred for pairs of instruments")
+
+	cmd.
+		Flags().
+		StringVar(&locationCostsFile, "location-costs", "", "CSV file with the cost per amount held of instruments per account type")
+
+	cmd.
+		Flags().
+		StringArrayVar(&accountTypes, "account-type", nil, "type of an account for its location costs, e.g. \"2222222=ISK\" (may be repeated)")
+
+	cmd.
+		Flags().
+		StringArrayVar(&locked, "lock", nil, "instrument to neither buy nor sell (may be repeated)")
+
+	cmd.
+		Flags().
+		StringArrayVar(&sellOnly, "sell-only", nil, "instrument to never buy (may be repeated)")
+
+	cmd.
+		Flags().
+		StringArrayVar(&buyOnly, "buy-only", nil, "instrument to never sell (may be repeated)")
+
+	cmd.
+		Flags().
+		StringArrayVar(&minWeights, "min-weight", nil, "smallest weight of an instrument after rebalancing, e.g. \"Avanza Zero=0.05\" (may be repeated)")
+
+	cmd.
+		Flags().
+		StringArrayVar(&maxWeights, "max-weight", nil, "largest weight of an instrument after rebalancing, e.g. \"Avanza Zero=0.3\" (may be repeated)")
+
+	cmd.
+		Flags().
+		StringVar(&baseCurrency, "base-currency", "", "currency to convert all positions into, e.g. SEK")
+
+	cmd.
+		Flags().
+		StringVar(&fxRatesFile, "fx-rates", "", "CSV file with exchange rates between currencies, e.g. \"USD,SEK,10.5\"")
+
+	cmd.
+		Flags().
+		StringVar(&dumpModelFile, "dump-model", "", "file to write the linear program to in CPLEX LP format if it cannot be solved")
+}
+
+func init() {
+	rootCmd.AddCommand(calculateCmd)
+
+	calculateCmd.
+		Flags().
+		StringVar(&positionsFile, "positions", "", "CSV or JSON file with the positions to rebalance")
+
+	calculateCmd.MarkFlagRequired("positions")
+
+	calculateCmd.
+		Flags().
+		StringVar(&targetsFile, "targets", "", "model portfolio file in JSON, YAML or TOML format with the targets")
+
+	calculateCmd.MarkFlagRequired("targets")
+
+	addCalculateFlags(calculateCmd)
+}
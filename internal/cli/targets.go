@@ -0,0 +1,20 @@
+package cli
+
+import (
+	"gitlab.joelpet.se/joelpet/go-rebalance/pkg/targets"
+	"gitlab.joelpet.se/joelpet/go-rebalance/pkg/transfers"
+)
+
+// readTargets reads the target distribution from a model portfolio file,
+// along with the options that set its asset classes, if any.
+func readTargets(filename string) ([]transfers.Distribution, []transfers.Option, error) {
+	portfolio, err := targets.ReadFile(filename)
+	if err != nil {
+		return nil, nil, err
+	}
+	var opts []transfers.Option
+	if classes := portfolio.AssetClasses(); classes != nil {
+		opts = append(opts, transfers.WithAssetClasses(classes))
+	}
+	return portfolio.Distributions(), opts, nil
+}
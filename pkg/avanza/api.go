@@ -1,84 +1,323 @@
 package avanza
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/imroc/req/v3"
+	"gitlab.joelpet.se/joelpet/go-rebalance/pkg/totp"
+	"golang.org/x/time/rate"
 )
 
+// baseURL is the URL that the API is found at.
+const baseURL = "https://www.avanza.se"
+
+// securityTokenHeader is the header that the security token of a session is
+// sent in.
+const securityTokenHeader = "X-SecurityToken"
+
+// ErrUnauthenticated is returned when Avanza rejects a request for lack of a
+// valid session, i.e. with status 401 or 403, see APIError.
+var ErrUnauthenticated = errors.New("avanza: unauthenticated")
+
+// APIError is an error response of the API.
+type APIError struct {
+	// StatusCode is the HTTP status code, e.g. 401
+	StatusCode int
+	// Code is Avanza's code of the error, if any, e.g. "SESSION_EXPIRED"
+	Code string
+	// Message describes the error, or is the HTTP status text if Avanza
+	// gave no message.
+	Message string
+}
+
+func (e *APIError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("status %d: %s: %s", e.StatusCode, e.Code, e.Message)
+	}
+	return fmt.Sprintf("status %d: %s", e.StatusCode, e.Message)
+}
+
+// Is reports whether the error is ErrUnauthenticated, which it is for status
+// 401 and 403.
+func (e *APIError) Is(target error) bool {
+	return target == ErrUnauthenticated &&
+		(e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden)
+}
+
+// errorPayload is the body of an error response.
+type errorPayload struct {
+	ErrorCode string `json:"errorCode"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+}
+
+// check returns the error of the request, if it failed, or an *APIError if
+// Avanza responded with an error status. Otherwise, it decodes the body of
+// the response into v.
+func check(resp *req.Response, v interface{}) error {
+	if resp.Err != nil {
+		return resp.Err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		apiErr := &APIError{StatusCode: resp.StatusCode}
+		var payload errorPayload
+		if json.Unmarshal(resp.Bytes(), &payload) == nil {
+			apiErr.Code, apiErr.Message = payload.ErrorCode, payload.Message
+			if apiErr.Code == "" {
+				apiErr.Code = payload.Code
+			}
+		}
+		if apiErr.Message == "" {
+			apiErr.Message = http.StatusText(resp.StatusCode)
+		}
+		return apiErr
+	}
+	return resp.Into(v)
+}
+
+// Errors returned when logging in.
+var (
+	ErrWrongCredentials  = errors.New("avanza: wrong username, password or code")
+	ErrAccountLocked     = errors.New("avanza: account locked")
+	ErrUnsupportedMethod = errors.New("avanza: unsupported two-factor method")
+)
+
+// transactionCookie is the cookie that the transaction ID of a two-factor
+// login is sent in.
+const transactionCookie = "AZAMFATRANSACTION"
+
 // Client gives access to Avanza's unofficial backend API.
 type Client struct {
-	req *req.Client
+	req     *req.Client
+	baseURL string
+
+	// The number of inactive minutes before the session expires, as
+	// requested when authenticating
+	maxInactiveMinutes uint
+	session            *Session
+}
+
+// NewClient returns a client that times out, retries and limits the rate of
+// its requests as configured by the options.
+func NewClient(opts ...Option) (*Client, error) {
+	o := newOptions(opts)
+	c := req.C().
+		SetBaseURL(o.baseURL).
+		SetTimeout(o.timeout)
+
+	if o.retries > 0 {
+		c.SetCommonRetryCount(o.retries).
+			SetCommonRetryCondition(retryable)
+		if o.minBackoff > 0 {
+			c.SetCommonRetryBackoffInterval(o.minBackoff, o.maxBackoff)
+		}
+	}
+
+	if o.rateLimit > 0 {
+		// Each attempt of a request, including retries, waits for its turn.
+		limiter := rate.NewLimiter(rate.Every(o.rateLimit), 1)
+		c.WrapRoundTripFunc(func(rt req.RoundTripper) req.RoundTripFunc {
+			return func(r *req.Request) (*req.Response, error) {
+				if err := limiter.Wait(r.Context()); err != nil {
+					return &req.Response{Request: r}, err
+				}
+				return rt.RoundTrip(r)
+			}
+		})
+	}
+
+	return &Client{req: c, baseURL: o.baseURL}, nil
+}
+
+// retryable reports whether a request should be retried, which it should
+// after a network error or a response with status 429 or 5xx, unless its
+// context is done. Only GET requests are retried, so that logins are never
+// repeated, as that could lock the account or reuse a TOTP code.
+func retryable(resp *req.Response, err error) bool {
+	if resp.Request == nil || resp.Request.Method != http.MethodGet || resp.Request.Context().Err() != nil {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// Session is an authenticated session, which may be saved and restored with
+// SetSession to avoid logging in again until it expires.
+type Session struct {
+	// SecurityToken is sent along with each request, e.g.
+	// "xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx"
+	SecurityToken string `json:"securityToken"`
+	// Authentication session, e.g. "xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx"
+	AuthenticationSession string `json:"authenticationSession"`
+	// Cookies are the session cookies.
+	Cookies []*http.Cookie `json:"cookies"`
+	// MaxInactiveMinutes is the number of inactive minutes before the
+	// session expires, see UserCredentials.AuthTimeout.
+	MaxInactiveMinutes uint `json:"maxInactiveMinutes"`
+	// Expires is when the session expires unless used before then.
+	Expires time.Time `json:"expires"`
 }
 
-func NewClient() (*Client, error) {
-	return &Client{
-		req: req.C().
-			SetBaseURL("https://www.avanza.se"),
-	}, nil
+// Expired reports whether the session has expired at the given time.
+func (s *Session) Expired(now time.Time) bool {
+	return !now.Before(s.Expires)
 }
 
-func (c Client) Authenticate(creds UserCredentials) error {
+// Session returns the authenticated session of the client, or nil if it has
+// none.
+func (c *Client) Session() (*Session, error) {
+	if c.session == nil {
+		return nil, nil
+	}
+	cookies, err := c.req.GetCookies(c.baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("avanza: getting session cookies: %s", err)
+	}
+	session := *c.session
+	session.Cookies = cookies
+	return &session, nil
+}
+
+// SetSession makes the client use a session saved from another client rather
+// than authenticating. Requests fail with ErrUnauthenticated if Avanza no
+// longer accepts it.
+func (c *Client) SetSession(session *Session) error {
+	jar := c.req.GetClient().Jar
+	if jar == nil {
+		return errors.New("avanza: setting session cookies: no cookie jar")
+	}
+	u, err := url.Parse(c.baseURL)
+	if err != nil {
+		return fmt.Errorf("avanza: setting session cookies: %s", err)
+	}
+	jar.SetCookies(u, session.Cookies)
+	c.req.SetCommonHeader(securityTokenHeader, session.SecurityToken)
+	c.maxInactiveMinutes = session.MaxInactiveMinutes
+	c.session = session
+	return nil
+}
+
+// touch extends the session, if any, by the number of inactive minutes from
+// now, as it has just been used.
+func (c *Client) touch() {
+	if c.session != nil {
+		c.session.Expires = time.Now().Add(time.Duration(c.maxInactiveMinutes) * time.Minute)
+	}
+}
+
+// Authenticate logs in with username and password, which either starts the
+// session of the client or requires a second factor, as told by the returned
+// Authentication. It returns ErrWrongCredentials, ErrAccountLocked or
+// ErrUnsupportedMethod if Avanza rejects the login or requires an unknown
+// second factor.
+func (c *Client) Authenticate(ctx context.Context, creds UserCredentials) (*Authentication, error) {
 	if creds.AuthTimeout < 30 || creds.AuthTimeout > 60*24 {
-		return fmt.Errorf("avanza: invalid auth timeout: %d", creds.AuthTimeout)
+		return nil, fmt.Errorf("avanza: invalid auth timeout: %d", creds.AuthTimeout)
 	}
+	c.maxInactiveMinutes = creds.AuthTimeout
 
 	var payload authenticatePayload
 
-	err := c.req.Post("/_api/authentication/sessions/usercredentials").
+	resp := c.req.Post("/_api/authentication/sessions/usercredentials").
 		SetBody(creds).
-		Do().
-		Into(&payload)
+		Do(ctx)
 
-	if err != nil {
-		return fmt.Errorf("avanza: post auth req: %v", err)
+	if err := check(resp, &payload); err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) {
+			switch apiErr.StatusCode {
+			case http.StatusUnauthorized:
+				return nil, fmt.Errorf("%w: %s", ErrWrongCredentials, apiErr)
+			case http.StatusForbidden, http.StatusLocked:
+				return nil, fmt.Errorf("%w: %s", ErrAccountLocked, apiErr)
+			}
+		}
+		return nil, fmt.Errorf("avanza: post auth req: %w", err)
 	}
 
-	// TODO: Indicate whether two-factor authentication is necessary
-
-	return nil
+	auth := &Authentication{TransactionID: payload.TwoFactorLogin.TransactionID}
+	switch method := SecondFactor(strings.ToUpper(payload.TwoFactorLogin.Method)); method {
+	case SecondFactorNone:
+		c.startSession(resp.GetHeader(securityTokenHeader), payload.AuthenticationSession)
+	case SecondFactorTOTP, SecondFactorBankID:
+		auth.SecondFactor = method
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedMethod, payload.TwoFactorLogin.Method)
+	}
+	return auth, nil
 }
 
-// TOTP performs a time based one-time password two factor login.
-func (c *Client) TOTP(totp TOTP) error {
+// TOTP performs a time based one-time password two factor login, which
+// starts the session of the client. It returns ErrUnsupportedMethod if the
+// authentication requires another second factor.
+func (c *Client) TOTP(ctx context.Context, auth *Authentication, totp TOTP) error {
+	if auth.SecondFactor != SecondFactorTOTP {
+		return fmt.Errorf("%w: TOTP when %s is required", ErrUnsupportedMethod, auth.SecondFactor)
+	}
+
 	var payload totpPayload
 
-	err := c.req.Post("/_api/authentication/sessions/totp").
+	resp := c.req.Post("/_api/authentication/sessions/totp").
+		SetCookies(&http.Cookie{Name: transactionCookie, Value: auth.TransactionID}).
 		SetBody(totp).
-		Do().
-		Into(&payload)
+		Do(ctx)
 
-	if err != nil {
-		return fmt.Errorf("avanza: providing TOTP: %s", err)
+	if err := check(resp, &payload); err != nil {
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusUnauthorized {
+			return fmt.Errorf("%w: %s", ErrWrongCredentials, apiErr)
+		}
+		return fmt.Errorf("avanza: providing TOTP: %w", err)
 	}
 
+	c.startSession(resp.GetHeader(securityTokenHeader), payload.AuthenticationSession)
 	return nil
 }
 
-func (c *Client) GetPositions() (*PositionsPayload, error) {
+// startSession starts the session of the given security token.
+func (c *Client) startSession(token, authenticationSession string) {
+	c.req.SetCommonHeader(securityTokenHeader, token)
+	c.session = &Session{
+		SecurityToken:         token,
+		AuthenticationSession: authenticationSession,
+		MaxInactiveMinutes:    c.maxInactiveMinutes,
+	}
+	c.touch()
+}
+
+func (c *Client) GetPositions(ctx context.Context) (*PositionsPayload, error) {
 	var payload PositionsPayload
 
-	err := c.req.Get("/_api/position-data/positions").
-		Do().
-		Into(&payload)
+	resp := c.req.Get("/_api/position-data/positions").
+		Do(ctx)
 
-	if err != nil {
-		return nil, fmt.Errorf("avanza: getting positions: %s", err)
+	if err := check(resp, &payload); err != nil {
+		return nil, fmt.Errorf("avanza: getting positions: %w", err)
 	}
+	c.touch()
 
 	return &payload, nil
 }
 
-func (c *Client) GetPeriodicSavings() (*PeriodicSavingsPayload, error) {
+func (c *Client) GetPeriodicSavings(ctx context.Context) (*PeriodicSavingsPayload, error) {
 	var payload PeriodicSavingsPayload
 
-	err := c.req.Get("/_api/periodic-fund-saving/get-periodic-savings").
-		Do().
-		Into(&payload)
+	resp := c.req.Get("/_api/periodic-fund-saving/get-periodic-savings").
+		Do(ctx)
 
-	if err != nil {
-		return nil, fmt.Errorf("avanza: getting periodic savings: %s", err)
+	if err := check(resp, &payload); err != nil {
+		return nil, fmt.Errorf("avanza: getting periodic savings: %w", err)
 	}
+	c.touch()
 
 	return &payload, nil
 }
@@ -100,8 +339,41 @@ type TOTP struct {
 	TOTPCode string `json:"totpCode"`
 }
 
+// NewTOTP returns the TOTP for the code of the base32 encoded secret of the
+// authenticator app at the given time.
+func NewTOTP(secret string, now time.Time) (TOTP, error) {
+	code, err := totp.Code(secret, now)
+	if err != nil {
+		return TOTP{}, fmt.Errorf("avanza: generating TOTP code: %w", err)
+	}
+	return TOTP{Method: "TOTP", TOTPCode: code}, nil
+}
+
+// SecondFactor is a method of two-factor authentication.
+type SecondFactor string
+
+// Second factors that Avanza may require when logging in.
+const (
+	SecondFactorNone   SecondFactor = ""
+	SecondFactorTOTP   SecondFactor = "TOTP"
+	SecondFactorBankID SecondFactor = "BANKID"
+)
+
+// Authentication is the result of logging in with username and password.
+type Authentication struct {
+	// SecondFactor is the method required to start the session, or
+	// SecondFactorNone if it has already started.
+	SecondFactor SecondFactor
+	// TransactionID identifies the login in the second step, e.g.
+	// "xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx"
+	TransactionID string
+}
+
 type authenticatePayload struct {
-	TwoFactorLogin struct {
+	// Authentication session, if no second factor is required, e.g.
+	// "xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx"
+	AuthenticationSession string `json:"authenticationSession"`
+	TwoFactorLogin        struct {
 		// Transaction id, e.g. "xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx"
 		TransactionID string `json:"transactionId"`
 		// 2FA method, e.g. "TOTP"
@@ -127,6 +399,7 @@ type PositionsPayload struct {
 		Account struct {
 			ID   string `json:"id"`
 			Name string `json:"name"`
+			Type string `json:"type"`
 		} `json:"account"`
 		TotalBalance struct {
 			Value float64 `json:"value"`
@@ -139,11 +412,18 @@ type Position struct {
 	Account struct {
 		ID   string `json:"id"`
 		Name string `json:"name"`
+		// Account type, e.g. "INVESTERINGSSPARKONTO"
+		Type string `json:"type"`
 	} `json:"account"`
 	Instrument struct {
-		ID       string `json:"id"`
-		Name     string `json:"name"`
-		Currency string `json:"currency"`
+		ID        string `json:"id"`
+		Name      string `json:"name"`
+		Currency  string `json:"currency"`
+		ISIN      string `json:"isin"`
+		Orderbook struct {
+			// Orderbook id, e.g. "878733"
+			ID string `json:"id"`
+		} `json:"orderbook"`
 	} `json:"instrument"`
 	Value struct {
 		Value float64 `json:"value"`
@@ -0,0 +1,518 @@
+package avanza
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a client of the fake server of the API, which does
+// not limit the rate of its requests.
+func newTestClient(t *testing.T, srv *httptest.Server, opts ...Option) *Client {
+	opts = append([]Option{
+		withBaseURL(srv.URL),
+		WithRateLimit(0),
+		WithBackoff(time.Millisecond, time.Millisecond),
+	}, opts...)
+	c, err := NewClient(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestAPIError(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		status          int
+		body            string
+		want            APIError
+		unauthenticated bool
+	}{
+		{
+			name:            "unauthorized",
+			status:          http.StatusUnauthorized,
+			body:            `{"errorCode":"SESSION_EXPIRED","message":"Session has expired"}`,
+			want:            APIError{StatusCode: 401, Code: "SESSION_EXPIRED", Message: "Session has expired"},
+			unauthenticated: true,
+		},
+		{
+			name:            "forbidden",
+			status:          http.StatusForbidden,
+			want:            APIError{StatusCode: 403, Message: "Forbidden"},
+			unauthenticated: true,
+		},
+		{
+			name:   "server error",
+			status: http.StatusInternalServerError,
+			body:   `{"errorCode":"INTERNAL_ERROR","message":"Something went wrong"}`,
+			want:   APIError{StatusCode: 500, Code: "INTERNAL_ERROR", Message: "Something went wrong"},
+		},
+		{
+			name:   "code",
+			status: http.StatusBadRequest,
+			body:   `{"code":"INVALID","message":"Invalid request"}`,
+			want:   APIError{StatusCode: 400, Code: "INVALID", Message: "Invalid request"},
+		},
+		{
+			name:   "not json",
+			status: http.StatusBadGateway,
+			body:   "<html><body>Bad gateway</body></html>",
+			want:   APIError{StatusCode: 502, Message: "Bad Gateway"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer srv.Close()
+			c := newTestClient(t, srv, WithRetries(0))
+
+			payload, err := c.GetPositions(context.Background())
+			if payload != nil {
+				t.Errorf("GetPositions() = %+v, want nil", payload)
+			}
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("GetPositions() error = %v, want *APIError", err)
+			}
+			if want, got := tc.want, *apiErr; want != got {
+				t.Errorf("GetPositions() error = %+v, want %+v", got, want)
+			}
+			if want, got := tc.unauthenticated, errors.Is(err, ErrUnauthenticated); want != got {
+				t.Errorf("errors.Is(%v, ErrUnauthenticated) = %t, want %t", err, got, want)
+			}
+		})
+	}
+}
+
+func TestAPIError_Error(t *testing.T) {
+	for _, tc := range []struct {
+		err  APIError
+		want string
+	}{
+		{APIError{StatusCode: 401, Code: "SESSION_EXPIRED", Message: "Session has expired"}, "status 401: SESSION_EXPIRED: Session has expired"},
+		{APIError{StatusCode: 502, Message: "Bad Gateway"}, "status 502: Bad Gateway"},
+	} {
+		if got := tc.err.Error(); tc.want != got {
+			t.Errorf("Error() = %q, want %q", got, tc.want)
+		}
+	}
+}
+
+func TestGetPositions(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if want, got := "/_api/position-data/positions", r.URL.Path; want != got {
+			t.Errorf("request path = %s, want %s", got, want)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"withOrderbook":[{"instrument":{"name":"Avanza Global"},"value":{"value":1234.56,"unit":"SEK"}}]}`))
+	}))
+	defer srv.Close()
+	c := newTestClient(t, srv)
+
+	payload, err := c.GetPositions(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 1, len(payload.WithOrderbook); want != got {
+		t.Fatalf("GetPositions() has %d positions with orderbook, want %d", got, want)
+	}
+	if want, got := 1234.56, payload.WithOrderbook[0].Value.Value; want != got {
+		t.Errorf("GetPositions() value = %v, want %v", got, want)
+	}
+}
+
+// fakeSessions is a fake server of the API that starts a session of a new
+// security token and cookie for each login without a second factor, and
+// only serves the positions within the session last started.
+type fakeSessions struct {
+	mu      sync.Mutex
+	logins  int
+	token   string
+	cookie  string
+	revoked bool
+}
+
+func (f *fakeSessions) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.URL.Path {
+	case "/_api/authentication/sessions/usercredentials":
+		f.logins++
+		f.token, f.cookie, f.revoked = fmt.Sprintf("token-%d", f.logins), fmt.Sprintf("cookie-%d", f.logins), false
+		w.Header().Set(securityTokenHeader, f.token)
+		http.SetCookie(w, &http.Cookie{Name: "csid", Value: f.cookie, Path: "/"})
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"authenticationSession":"session-%d","twoFactorLogin":{}}`, f.logins)
+	case "/_api/position-data/positions":
+		cookie, err := r.Cookie("csid")
+		if f.revoked || r.Header.Get(securityTokenHeader) != f.token || err != nil || cookie.Value != f.cookie {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// revoke makes the server reject the session last started.
+func (f *fakeSessions) revoke() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.revoked = true
+}
+
+func TestSession(t *testing.T) {
+	ctx := context.Background()
+	server := &fakeSessions{}
+	creds := UserCredentials{Username: "1111111", Password: "password", AuthTimeout: 60}
+
+	srv := httptest.NewServer(server)
+	defer srv.Close()
+	c := newTestClient(t, srv)
+	if session, err := c.Session(); err != nil || session != nil {
+		t.Errorf("Session() before login = %+v, %v, want nil", session, err)
+	}
+	if _, err := c.Authenticate(ctx, creds); err != nil {
+		t.Fatal(err)
+	}
+	session, err := c.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "token-1", session.SecurityToken; want != got {
+		t.Errorf("Session().SecurityToken = %s, want %s", got, want)
+	}
+	if want, got := "session-1", session.AuthenticationSession; want != got {
+		t.Errorf("Session().AuthenticationSession = %s, want %s", got, want)
+	}
+	if want, got := uint(60), session.MaxInactiveMinutes; want != got {
+		t.Errorf("Session().MaxInactiveMinutes = %d, want %d", got, want)
+	}
+	if session.Expired(time.Now().Add(59*time.Minute)) || !session.Expired(time.Now().Add(61*time.Minute)) {
+		t.Errorf("Session().Expires = %v, want in an hour", session.Expires)
+	}
+
+	// Another client, e.g. of a later run, reuses the saved session.
+	data, err := json.Marshal(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved Session
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	restored := newTestClient(t, srv)
+	if err := restored.SetSession(&saved); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restored.GetPositions(ctx); err != nil {
+		t.Fatalf("GetPositions() with restored session error = %v", err)
+	}
+	server.mu.Lock()
+	if want, got := 1, server.logins; want != got {
+		t.Errorf("logins = %d, want %d", got, want)
+	}
+	server.mu.Unlock()
+
+	// Until Avanza rejects it, after which logging in again starts a new
+	// session.
+	server.revoke()
+	if _, err := restored.GetPositions(ctx); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("GetPositions() with rejected session error = %v, want %v", err, ErrUnauthenticated)
+	}
+	if _, err := restored.Authenticate(ctx, creds); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restored.GetPositions(ctx); err != nil {
+		t.Fatalf("GetPositions() after logging in again error = %v", err)
+	}
+	if session, err := restored.Session(); err != nil {
+		t.Fatal(err)
+	} else if want, got := "token-2", session.SecurityToken; want != got {
+		t.Errorf("Session().SecurityToken = %s, want %s", got, want)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		status int
+		body   string
+		want   Authentication
+		err    error
+	}{
+		{
+			name:   "no second factor",
+			status: http.StatusOK,
+			body:   `{"authenticationSession":"session-1","twoFactorLogin":{}}`,
+			want:   Authentication{SecondFactor: SecondFactorNone},
+		},
+		{
+			name:   "totp",
+			status: http.StatusOK,
+			body:   `{"twoFactorLogin":{"transactionId":"transaction-1","method":"TOTP"}}`,
+			want:   Authentication{SecondFactor: SecondFactorTOTP, TransactionID: "transaction-1"},
+		},
+		{
+			name:   "bankid",
+			status: http.StatusOK,
+			body:   `{"twoFactorLogin":{"transactionId":"transaction-1","method":"BankID"}}`,
+			want:   Authentication{SecondFactor: SecondFactorBankID, TransactionID: "transaction-1"},
+		},
+		{
+			name:   "unknown method",
+			status: http.StatusOK,
+			body:   `{"twoFactorLogin":{"transactionId":"transaction-1","method":"SMS"}}`,
+			err:    ErrUnsupportedMethod,
+		},
+		{
+			name:   "wrong password",
+			status: http.StatusUnauthorized,
+			body:   `{"message":"Felaktigt användarnamn eller lösenord"}`,
+			err:    ErrWrongCredentials,
+		},
+		{
+			name:   "forbidden",
+			status: http.StatusForbidden,
+			err:    ErrAccountLocked,
+		},
+		{
+			name:   "locked",
+			status: http.StatusLocked,
+			err:    ErrAccountLocked,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var creds UserCredentials
+				if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+					t.Errorf("decoding credentials: %v", err)
+				}
+				if want, got := (UserCredentials{Username: "1111111", Password: "password", AuthTimeout: 60}), creds; want != got {
+					t.Errorf("credentials = %+v, want %+v", got, want)
+				}
+				w.Header().Set(securityTokenHeader, "token-1")
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer srv.Close()
+			c := newTestClient(t, srv)
+
+			auth, err := c.Authenticate(context.Background(), UserCredentials{Username: "1111111", Password: "password", AuthTimeout: 60})
+			if tc.err != nil {
+				if !errors.Is(err, tc.err) {
+					t.Errorf("Authenticate() error = %v, want %v", err, tc.err)
+				}
+				if errors.Is(err, ErrWrongCredentials) && errors.Is(err, ErrAccountLocked) {
+					t.Errorf("Authenticate() error = %v, want only one of %v and %v", err, ErrWrongCredentials, ErrAccountLocked)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, got := tc.want, *auth; want != got {
+				t.Errorf("Authenticate() = %+v, want %+v", got, want)
+			}
+
+			// The session only starts once no second factor remains.
+			session, err := c.Session()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, got := tc.want.SecondFactor == SecondFactorNone, session != nil; want != got {
+				t.Errorf("Session() = %+v, want a session %t", session, want)
+			}
+		})
+	}
+
+	if _, err := (&Client{}).Authenticate(context.Background(), UserCredentials{AuthTimeout: 10}); err == nil {
+		t.Error("Authenticate() with invalid auth timeout succeeded, want error")
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if want, got := "/_api/authentication/sessions/totp", r.URL.Path; want != got {
+			t.Errorf("request path = %s, want %s", got, want)
+		}
+		cookie, err := r.Cookie(transactionCookie)
+		if err != nil || cookie.Value != "transaction-1" {
+			t.Errorf("transaction cookie = %v, %v, want transaction-1", cookie, err)
+		}
+		var totp TOTP
+		if err := json.NewDecoder(r.Body).Decode(&totp); err != nil {
+			t.Errorf("decoding TOTP: %v", err)
+		}
+		if totp.TOTPCode != "123456" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set(securityTokenHeader, "token-1")
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"authenticationSession":"session-1"}`))
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+	auth := &Authentication{SecondFactor: SecondFactorTOTP, TransactionID: "transaction-1"}
+
+	c := newTestClient(t, srv)
+	if err := c.TOTP(ctx, auth, TOTP{Method: "TOTP", TOTPCode: "654321"}); !errors.Is(err, ErrWrongCredentials) {
+		t.Errorf("TOTP() with wrong code error = %v, want %v", err, ErrWrongCredentials)
+	}
+	if err := c.TOTP(ctx, auth, TOTP{Method: "TOTP", TOTPCode: "123456"}); err != nil {
+		t.Fatal(err)
+	}
+	session, err := c.Session()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session == nil || session.SecurityToken != "token-1" || session.AuthenticationSession != "session-1" {
+		t.Errorf("Session() = %+v, want token-1 and session-1", session)
+	}
+
+	bankID := &Authentication{SecondFactor: SecondFactorBankID, TransactionID: "transaction-1"}
+	if err := c.TOTP(ctx, bankID, TOTP{Method: "TOTP", TOTPCode: "123456"}); !errors.Is(err, ErrUnsupportedMethod) {
+		t.Errorf("TOTP() when BankID is required error = %v, want %v", err, ErrUnsupportedMethod)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	// fail makes the request fail with a network error.
+	fail := func(w http.ResponseWriter) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	}
+
+	for _, tc := range []struct {
+		name     string
+		request  func(ctx context.Context, c *Client) error
+		failures []int
+		attempts int
+		ok       bool
+	}{
+		{
+			name:     "too many requests",
+			request:  getPositions,
+			failures: []int{http.StatusTooManyRequests},
+			attempts: 2,
+			ok:       true,
+		},
+		{
+			name:     "server errors",
+			request:  getPositions,
+			failures: []int{http.StatusInternalServerError, http.StatusServiceUnavailable},
+			attempts: 3,
+			ok:       true,
+		},
+		{
+			name:     "network error",
+			request:  getPositions,
+			failures: []int{0},
+			attempts: 2,
+			ok:       true,
+		},
+		{
+			name:     "too many failures",
+			request:  getPositions,
+			failures: []int{500, 502, 503, 504},
+			attempts: 4,
+		},
+		{
+			name:     "not found",
+			request:  getPositions,
+			failures: []int{http.StatusNotFound},
+			attempts: 1,
+		},
+		{
+			name:     "unauthorized",
+			request:  getPositions,
+			failures: []int{http.StatusUnauthorized},
+			attempts: 1,
+		},
+		{
+			name: "login",
+			request: func(ctx context.Context, c *Client) error {
+				_, err := c.Authenticate(ctx, UserCredentials{Username: "1111111", Password: "password", AuthTimeout: 60})
+				return err
+			},
+			failures: []int{http.StatusServiceUnavailable},
+			attempts: 1,
+		},
+		{
+			name: "login network error",
+			request: func(ctx context.Context, c *Client) error {
+				_, err := c.Authenticate(ctx, UserCredentials{Username: "1111111", Password: "password", AuthTimeout: 60})
+				return err
+			},
+			failures: []int{0},
+			attempts: 1,
+		},
+		{
+			name: "totp",
+			request: func(ctx context.Context, c *Client) error {
+				auth := &Authentication{SecondFactor: SecondFactorTOTP, TransactionID: "transaction-1"}
+				return c.TOTP(ctx, auth, TOTP{Method: "TOTP", TOTPCode: "123456"})
+			},
+			failures: []int{http.StatusTooManyRequests},
+			attempts: 1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var mu sync.Mutex
+			attempts := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				attempt := attempts
+				attempts++
+				mu.Unlock()
+				if attempt < len(tc.failures) {
+					if status := tc.failures[attempt]; status == 0 {
+						fail(w)
+					} else {
+						w.WriteHeader(status)
+					}
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{}`))
+			}))
+			defer srv.Close()
+			c := newTestClient(t, srv, WithRetries(3))
+
+			err := tc.request(context.Background(), c)
+			if tc.ok && err != nil {
+				t.Errorf("request error = %v", err)
+			} else if !tc.ok && err == nil {
+				t.Error("request succeeded, want error")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if want, got := tc.attempts, attempts; want != got {
+				t.Errorf("attempts = %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+// getPositions gets the positions with the client.
+func getPositions(ctx context.Context, c *Client) error {
+	_, err := c.GetPositions(ctx)
+	return err
+}
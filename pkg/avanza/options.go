@@ -0,0 +1,73 @@
+package avanza
+
+import "time"
+
+// Option configures how the client makes requests.
+type Option func(*options)
+
+type options struct {
+	baseURL    string
+	timeout    time.Duration
+	retries    int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	rateLimit  time.Duration
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		baseURL:    baseURL,
+		timeout:    30 * time.Second,
+		retries:    3,
+		minBackoff: time.Second,
+		maxBackoff: 10 * time.Second,
+		rateLimit:  250 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithTimeout sets the time that each attempt of a request may take, or no
+// limit if zero. It defaults to 30 seconds.
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.timeout = timeout
+	}
+}
+
+// WithRetries sets the number of times that a GET request is retried after a
+// network error or a response with status 429 or 5xx, or never if zero. It
+// defaults to 3. Logins are never retried.
+func WithRetries(retries int) Option {
+	return func(o *options) {
+		o.retries = retries
+	}
+}
+
+// WithBackoff sets the time to wait before the first retry of a request,
+// which is doubled for each following retry up to max, with jitter. It
+// defaults to 1 to 10 seconds.
+func WithBackoff(min, max time.Duration) Option {
+	return func(o *options) {
+		o.minBackoff = min
+		o.maxBackoff = max
+	}
+}
+
+// WithRateLimit sets the least time between the requests of the client, or
+// no limit if zero. It defaults to 250 milliseconds.
+func WithRateLimit(interval time.Duration) Option {
+	return func(o *options) {
+		o.rateLimit = interval
+	}
+}
+
+// withBaseURL sets the URL that the API is found at, e.g. that of a fake
+// server in tests.
+func withBaseURL(url string) Option {
+	return func(o *options) {
+		o.baseURL = url
+	}
+}
@@ -20,15 +20,23 @@ func ReadAllPositions(filename string) ([]transfers.Position, error) {
 
 	var positions []transfers.Position
 	for _, p := range azapos.WithOrderbook {
+		// Monthly savings refer to instruments by their orderbook ids.
+		id := p.Instrument.Orderbook.ID
+		if id == "" {
+			id = p.Instrument.ID
+		}
 		position := transfers.Position{
 			Account: transfers.Account{
 				ID:   p.Account.ID,
 				Name: p.Account.Name,
+				Type: p.Account.Type,
 			},
 			Instrument: transfers.Fund{
 				BaseInstrument: transfers.BaseInstrument{
+					ID:       id,
 					Name:     p.Instrument.Name,
 					Currency: p.Instrument.Currency,
+					ISIN:     p.Instrument.ISIN,
 				},
 			},
 			Value: transfers.Value{
@@ -38,16 +46,40 @@ func ReadAllPositions(filename string) ([]transfers.Position, error) {
 		}
 		positions = append(positions, position)
 	}
+	for _, c := range azapos.CashPositions {
+		position := transfers.Position{
+			Account: transfers.Account{
+				ID:   c.Account.ID,
+				Name: c.Account.Name,
+				Type: c.Account.Type,
+			},
+			Instrument: transfers.Fund{
+				BaseInstrument: transfers.BaseInstrument{
+					Name:     transfers.CashName,
+					Currency: c.TotalBalance.Unit,
+					Type:     transfers.TypeCash,
+				},
+			},
+			Value: transfers.Value{
+				Value: c.TotalBalance.Value,
+				Unit:  c.TotalBalance.Unit,
+			},
+		}
+		positions = append(positions, position)
+	}
 
 	return positions, nil
 }
 
-// FilterPositions returns a slice with only those positions matching a given account id.
-func FilterPositions(positions []transfers.Position, accountID string) []transfers.Position {
+// FilterPositions returns a slice with only those positions matching any of the given account ids.
+func FilterPositions(positions []transfers.Position, accountIDs ...string) []transfers.Position {
 	filtered := make([]transfers.Position, 0, len(positions))
 	for _, p := range positions {
-		if p.Account.ID == accountID {
-			filtered = append(filtered, p)
+		for _, accountID := range accountIDs {
+			if p.Account.ID == accountID {
+				filtered = append(filtered, p)
+				break
+			}
 		}
 	}
 	return filtered
@@ -66,6 +98,7 @@ func ReadDistribution(filename string, accountID string) ([]transfers.Distributi
 		if strconv.Itoa(ps.Account.AccountID) == accountID {
 			for _, av := range ps.AllocationViews {
 				distribution := transfers.Distribution{
+					InstrumentID:   strconv.Itoa(av.OrderbookID),
 					InstrumentName: av.Name,
 					Distribution:   float64(av.Allocation) / 100,
 				}
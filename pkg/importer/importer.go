@@ -0,0 +1,213 @@
+// Package importer reads positions from files in a broker independent CSV or
+// JSON format.
+//
+// A CSV file has a header row that names its columns, in any order, of
+// which only name and value are required, although the name of cash may be
+// left empty:
+//
+//	account       id of the account that holds the position
+//	account_name  name of the account
+//	account_type  type of the account, e.g. ISK
+//	id            broker specific id of the instrument
+//	isin          ISIN of the instrument
+//	name          name of the instrument
+//	type          type of the instrument, where cash marks uninvested money
+//	currency      currency of the instrument, e.g. SEK
+//	value         current value of the position, e.g. 1234.56
+//	unit          currency of the value, if other than that of the instrument
+//
+// For example:
+//
+//	account,name,isin,type,currency,value
+//	2222222,Avanza Global,SE0000000000,,SEK,1234.56
+//	2222222,,,cash,SEK,100
+//
+// A JSON file holds an array of objects with the same members, in camel case,
+// e.g. accountName, where value is a number.
+package importer
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gitlab.joelpet.se/joelpet/go-rebalance/pkg/transfers"
+)
+
+// record is a position as read from file.
+type record struct {
+	Account     string      `json:"account"`
+	AccountName string      `json:"accountName"`
+	AccountType string      `json:"accountType"`
+	ID          string      `json:"id"`
+	ISIN        string      `json:"isin"`
+	Name        string      `json:"name"`
+	Type        string      `json:"type"`
+	Currency    string      `json:"currency"`
+	Value       json.Number `json:"value"`
+	Unit        string      `json:"unit"`
+}
+
+// typeCash is the type of the instrument of cash positions in files.
+const typeCash = "cash"
+
+// ReadPositions reads positions from file in the format given by its
+// extension, i.e. .csv or .json.
+func ReadPositions(filename string) ([]transfers.Position, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("importer: reading positions file: %s", err)
+	}
+	defer f.Close()
+
+	switch ext := strings.ToLower(filepath.Ext(filename)); ext {
+	case ".csv":
+		return ReadCSV(f)
+	case ".json":
+		return ReadJSON(f)
+	default:
+		return nil, fmt.Errorf("importer: unknown file extension: %q", ext)
+	}
+}
+
+// ReadCSV reads positions in CSV format from r.
+func ReadCSV(r io.Reader) ([]transfers.Position, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("importer: reading CSV: %s", err)
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("importer: reading CSV: no header")
+	}
+
+	columns := map[string]int{}
+	for i, name := range rows[0] {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range []string{"name", "value"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("importer: reading CSV: no %s column", name)
+		}
+	}
+	field := func(row []string, name string) string {
+		if i, ok := columns[name]; ok {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+
+	records := make([]record, len(rows)-1)
+	for i, row := range rows[1:] {
+		records[i] = record{
+			Account:     field(row, "account"),
+			AccountName: field(row, "account_name"),
+			AccountType: field(row, "account_type"),
+			ID:          field(row, "id"),
+			ISIN:        field(row, "isin"),
+			Name:        field(row, "name"),
+			Type:        field(row, "type"),
+			Currency:    field(row, "currency"),
+			Value:       json.Number(field(row, "value")),
+			Unit:        field(row, "unit"),
+		}
+	}
+	return positions(records)
+}
+
+// ReadJSON reads positions in JSON format from r.
+func ReadJSON(r io.Reader) ([]transfers.Position, error) {
+	var records []record
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	if err := decoder.Decode(&records); err != nil {
+		return nil, fmt.Errorf("importer: unmarshalling positions: %s", err)
+	}
+	return positions(records)
+}
+
+// decimalPrecision returns the number of decimals of a number in decimal or
+// scientific notation, leaving out trailing zeros, e.g. 1 for "100.10" and 0
+// for "1.5e3".
+func decimalPrecision(number string) int {
+	mantissa, exponent := strings.TrimLeft(number, "+-"), 0
+	if i := strings.IndexAny(mantissa, "eE"); i >= 0 {
+		exponent, _ = strconv.Atoi(mantissa[i+1:])
+		mantissa = mantissa[:i]
+	}
+	digits, scale := mantissa, -exponent
+	if dot := strings.IndexByte(mantissa, '.'); dot >= 0 {
+		digits = mantissa[:dot] + mantissa[dot+1:]
+		scale += len(mantissa) - dot - 1
+	}
+	for scale > 0 && strings.HasSuffix(digits, "0") {
+		digits, scale = digits[:len(digits)-1], scale-1
+	}
+	if scale < 0 {
+		return 0
+	}
+	return scale
+}
+
+// positions converts the records into positions, in which the decimal
+// precision of each value is the largest number of decimals that any value
+// of the same unit is written with, see decimalPrecision, as trailing zeros
+// may have been left out.
+func positions(records []record) ([]transfers.Position, error) {
+	positions := make([]transfers.Position, len(records))
+	precisions := map[string]int{}
+	for i, r := range records {
+		value, err := strconv.ParseFloat(string(r.Value), 64)
+		if err != nil {
+			return nil, fmt.Errorf("importer: parsing value of position %d: %s", i+1, err)
+		}
+
+		instrument := transfers.BaseInstrument{
+			ID:       r.ID,
+			Name:     r.Name,
+			Currency: r.Currency,
+			ISIN:     r.ISIN,
+		}
+		if strings.EqualFold(r.Type, typeCash) {
+			instrument.Type = transfers.TypeCash
+			if instrument.Name == "" {
+				instrument.Name = transfers.CashName
+			}
+		} else {
+			instrument.Type = r.Type
+		}
+		if instrument.Name == "" {
+			return nil, fmt.Errorf("importer: position %d has no instrument name", i+1)
+		}
+
+		unit := r.Unit
+		if unit == "" {
+			unit = r.Currency
+		}
+		if precision := decimalPrecision(string(r.Value)); precision > precisions[unit] {
+			precisions[unit] = precision
+		}
+		positions[i] = transfers.Position{
+			Account: transfers.Account{
+				ID:   r.Account,
+				Name: r.AccountName,
+				Type: r.AccountType,
+			},
+			Instrument: transfers.Fund{BaseInstrument: instrument},
+			Value: transfers.Value{
+				Value: value,
+				Unit:  unit,
+			},
+		}
+	}
+	for i := range positions {
+		positions[i].Value.DecimalPrecision = precisions[positions[i].Value.Unit]
+	}
+	return positions, nil
+}
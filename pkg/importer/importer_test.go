@@ -0,0 +1,97 @@
+package importer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gitlab.joelpet.se/joelpet/go-rebalance/pkg/transfers"
+)
+
+func TestRead(t *testing.T) {
+	account := transfers.Account{ID: "2222222", Name: "Savings", Type: "ISK"}
+	want := []transfers.Position{
+		{
+			Account:    account,
+			Instrument: transfers.Fund{BaseInstrument: transfers.BaseInstrument{Name: "Avanza Global", ISIN: "SE0000000000", Currency: "SEK"}},
+			Value:      transfers.Value{Value: 1234.56, Unit: "SEK", DecimalPrecision: 2},
+		},
+		{
+			Account:    account,
+			Instrument: transfers.Fund{BaseInstrument: transfers.BaseInstrument{Name: transfers.CashName, Currency: "SEK", Type: transfers.TypeCash}},
+			// The precision of the other value in SEK, as trailing
+			// zeros may have been left out.
+			Value: transfers.Value{Value: 100, Unit: "SEK", DecimalPrecision: 2},
+		},
+	}
+
+	got, err := ReadCSV(strings.NewReader(`account,account_name,account_type,name,isin,type,currency,value
+2222222,Savings,ISK,Avanza Global,SE0000000000,,SEK,1234.56
+2222222,Savings,ISK,,,cash,SEK,100
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("ReadCSV() = %+v, want %+v", got, want)
+	}
+
+	got, err = ReadJSON(strings.NewReader(`[
+  {"account": "2222222", "accountName": "Savings", "accountType": "ISK", "name": "Avanza Global", "isin": "SE0000000000", "currency": "SEK", "value": 1234.56},
+  {"account": "2222222", "accountName": "Savings", "accountType": "ISK", "type": "cash", "currency": "SEK", "value": 100}
+]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("ReadJSON() = %+v, want %+v", got, want)
+	}
+
+	if _, err := ReadCSV(strings.NewReader("name,currency\nAvanza Global,SEK\n")); err == nil {
+		t.Error("ReadCSV() without value column succeeded, want error")
+	}
+}
+
+func TestDecimalPrecision(t *testing.T) {
+	for _, tc := range []struct {
+		number string
+		want   int
+	}{
+		{"100", 0},
+		{"100.1", 1},
+		{"100.10", 1},
+		{"100.00", 0},
+		{"-1234.56", 2},
+		{"1.5e3", 0},
+		{"1.5E+3", 0},
+		{"1.25e1", 1},
+		{"1.5e-3", 4},
+		{"150e-2", 1},
+	} {
+		if got := decimalPrecision(tc.number); tc.want != got {
+			t.Errorf("decimalPrecision(%q) = %d, want %d", tc.number, got, tc.want)
+		}
+	}
+}
+
+func TestRead_Precision(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"100.10", "200", 1},
+		{"100.1", "200", 1},
+		{"1.5e3", "200.5", 1},
+		{"100.00", "200", 0},
+	} {
+		positions, err := ReadCSV(strings.NewReader("name,value\nA," + tc.a + "\nB," + tc.b + "\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, pos := range positions {
+			if want, got := tc.want, pos.Value.DecimalPrecision; want != got {
+				t.Errorf("ReadCSV(%s, %s) precision of %s = %d, want %d", tc.a, tc.b, pos.Instrument.Name, got, want)
+			}
+		}
+	}
+}
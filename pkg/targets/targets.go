@@ -0,0 +1,224 @@
+// Package targets reads target allocations from model portfolio files in
+// JSON, YAML or TOML format, independent of any broker.
+package targets
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gitlab.joelpet.se/joelpet/go-rebalance/pkg/transfers"
+	"gopkg.in/yaml.v3"
+)
+
+// Format is a file format of model portfolios.
+type Format string
+
+// Supported file formats.
+const (
+	FormatJSON Format = "json"
+	FormatYAML Format = "yaml"
+	FormatTOML Format = "toml"
+)
+
+// Portfolio is a model portfolio, i.e. the target weights of a set of
+// instruments, optionally grouped into a hierarchy of asset classes.
+//
+// In YAML, a portfolio looks like:
+//
+//	classes:
+//	  - name: equities
+//	    weight: 0.6
+//	    band: {absolute: 0.05}
+//	    classes:
+//	      - {name: global, weight: 0.7}
+//	      - {name: sweden, weight: 0.3}
+//	  - name: fixed income
+//	    weight: 0.4
+//	targets:
+//	  - id: "878733"
+//	    name: Avanza Global
+//	    weight: 1
+//	    class: equities/global
+//	    band: {absolute: 0.02}
+//	  - isin: SE0000000000
+//	    weight: 1
+//	    class: equities/sweden
+//	    restriction: buy-only
+//	  - name: Avanza Ränta
+//	    weight: 1
+//	    class: fixed income
+//	    maxWeight: 0.5
+type Portfolio struct {
+	// Classes is the hierarchy of asset classes, if any, see
+	// transfers.WithAssetClasses.
+	Classes []Class  `json:"classes" yaml:"classes" toml:"classes"`
+	Targets []Target `json:"targets" yaml:"targets" toml:"targets"`
+}
+
+// Class is an asset class with a weight relative to the other classes of its
+// parent.
+type Class struct {
+	Name   string  `json:"name" yaml:"name" toml:"name"`
+	Weight float64 `json:"weight" yaml:"weight" toml:"weight"`
+	// Band overrides the global tolerance band of the class.
+	Band    *Band   `json:"band" yaml:"band" toml:"band"`
+	Classes []Class `json:"classes" yaml:"classes" toml:"classes"`
+}
+
+// Target is the target weight of an instrument, which is identified by its
+// broker specific ID, its ISIN or its name, in that order.
+type Target struct {
+	ID   string `json:"id" yaml:"id" toml:"id"`
+	ISIN string `json:"isin" yaml:"isin" toml:"isin"`
+	Name string `json:"name" yaml:"name" toml:"name"`
+	// Weight is the decimal percentage of the instrument, e.g. 0.15, or its
+	// weight relative to the other instruments of its asset class.
+	Weight float64 `json:"weight" yaml:"weight" toml:"weight"`
+	// Class is the path of the asset class of the instrument, e.g.
+	// "equities/global".
+	Class string `json:"class" yaml:"class" toml:"class"`
+	// Band overrides the global tolerance band of the instrument.
+	Band *Band `json:"band" yaml:"band" toml:"band"`
+	// Restriction is one of locked, sell-only and buy-only, if any.
+	Restriction string  `json:"restriction" yaml:"restriction" toml:"restriction"`
+	MinWeight   float64 `json:"minWeight" yaml:"minWeight" toml:"minWeight"`
+	MaxWeight   float64 `json:"maxWeight" yaml:"maxWeight" toml:"maxWeight"`
+}
+
+// Band is a tolerance band, see transfers.Tolerance.
+type Band struct {
+	Absolute float64 `json:"absolute" yaml:"absolute" toml:"absolute"`
+	Relative float64 `json:"relative" yaml:"relative" toml:"relative"`
+}
+
+var restrictions = map[string]transfers.Restriction{
+	"":          transfers.Unrestricted,
+	"locked":    transfers.Locked,
+	"sell-only": transfers.SellOnly,
+	"buy-only":  transfers.BuyOnly,
+}
+
+// ReadFile reads a model portfolio from file in the format given by its
+// extension, i.e. .json, .yaml, .yml or .toml.
+func ReadFile(filename string) (*Portfolio, error) {
+	var format Format
+	switch ext := strings.ToLower(filepath.Ext(filename)); ext {
+	case ".json":
+		format = FormatJSON
+	case ".yaml", ".yml":
+		format = FormatYAML
+	case ".toml":
+		format = FormatTOML
+	default:
+		return nil, fmt.Errorf("targets: unknown file extension: %q", ext)
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("targets: reading targets file: %s", err)
+	}
+	defer f.Close()
+	return Decode(f, format)
+}
+
+// Decode reads a model portfolio from r in the given format.
+func Decode(r io.Reader, format Format) (*Portfolio, error) {
+	var p Portfolio
+	var err error
+	switch format {
+	case FormatJSON:
+		err = json.NewDecoder(r).Decode(&p)
+	case FormatYAML:
+		err = yaml.NewDecoder(r).Decode(&p)
+	case FormatTOML:
+		_, err = toml.NewDecoder(r).Decode(&p)
+	default:
+		return nil, fmt.Errorf("targets: unknown format: %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("targets: decoding %s: %s", format, err)
+	}
+
+	for i, t := range p.Targets {
+		if t.ID == "" && t.ISIN == "" && t.Name == "" {
+			return nil, fmt.Errorf("targets: target %d has neither id, isin nor name", i+1)
+		}
+		if _, ok := restrictions[t.Restriction]; !ok {
+			return nil, fmt.Errorf("targets: unknown restriction of %s: %q", t.label(), t.Restriction)
+		}
+	}
+	return &p, nil
+}
+
+// label returns the name of the instrument of the target, or its ISIN or ID
+// if it has no name.
+func (t Target) label() string {
+	switch {
+	case t.Name != "":
+		return t.Name
+	case t.ISIN != "":
+		return t.ISIN
+	default:
+		return t.ID
+	}
+}
+
+// Distributions returns the targets as a target distribution.
+func (p *Portfolio) Distributions() []transfers.Distribution {
+	distributions := make([]transfers.Distribution, len(p.Targets))
+	for i, t := range p.Targets {
+		distributions[i] = transfers.Distribution{
+			InstrumentID:   t.ID,
+			ISIN:           t.ISIN,
+			InstrumentName: t.label(),
+			Distribution:   t.Weight,
+			AssetClass:     t.Class,
+		}
+		if t.Band != nil {
+			distributions[i].Tolerance = &transfers.Tolerance{
+				Absolute: t.Band.Absolute,
+				Relative: t.Band.Relative,
+			}
+		}
+		if t.Restriction != "" || t.MinWeight != 0 || t.MaxWeight != 0 {
+			distributions[i].Constraint = &transfers.Constraint{
+				Restriction: restrictions[t.Restriction],
+				MinWeight:   t.MinWeight,
+				MaxWeight:   t.MaxWeight,
+			}
+		}
+	}
+	return distributions
+}
+
+// AssetClasses returns the hierarchy of asset classes, or nil if there is
+// none.
+func (p *Portfolio) AssetClasses() []transfers.AssetClass {
+	var convert func(classes []Class) []transfers.AssetClass
+	convert = func(classes []Class) []transfers.AssetClass {
+		if len(classes) == 0 {
+			return nil
+		}
+		converted := make([]transfers.AssetClass, len(classes))
+		for i, c := range classes {
+			converted[i] = transfers.AssetClass{
+				Name:    c.Name,
+				Weight:  c.Weight,
+				Classes: convert(c.Classes),
+			}
+			if c.Band != nil {
+				converted[i].Tolerance = &transfers.Tolerance{
+					Absolute: c.Band.Absolute,
+					Relative: c.Band.Relative,
+				}
+			}
+		}
+		return converted
+	}
+	return convert(p.Classes)
+}
@@ -0,0 +1,88 @@
+package targets
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gitlab.joelpet.se/joelpet/go-rebalance/pkg/transfers"
+)
+
+func TestDecode(t *testing.T) {
+	want := []transfers.Distribution{
+		{InstrumentID: "878733", InstrumentName: "Avanza Global", Distribution: 0.7, AssetClass: "equities",
+			Tolerance: &transfers.Tolerance{Absolute: 0.02}},
+		{ISIN: "SE0000000000", InstrumentName: "SE0000000000", Distribution: 0.3, AssetClass: "bonds",
+			Constraint: &transfers.Constraint{Restriction: transfers.BuyOnly, MaxWeight: 0.5}},
+	}
+	for format, input := range map[Format]string{
+		FormatJSON: `{
+  "classes": [{"name": "equities", "weight": 0.6}, {"name": "bonds", "weight": 0.4, "band": {"relative": 0.1}}],
+  "targets": [
+    {"id": "878733", "name": "Avanza Global", "weight": 0.7, "class": "equities", "band": {"absolute": 0.02}},
+    {"isin": "SE0000000000", "weight": 0.3, "class": "bonds", "restriction": "buy-only", "maxWeight": 0.5}
+  ]
+}`,
+		FormatYAML: `
+classes:
+  - {name: equities, weight: 0.6}
+  - {name: bonds, weight: 0.4, band: {relative: 0.1}}
+targets:
+  - id: 878733
+    name: Avanza Global
+    weight: 0.7
+    class: equities
+    band: {absolute: 0.02}
+  - isin: SE0000000000
+    weight: 0.3
+    class: bonds
+    restriction: buy-only
+    maxWeight: 0.5
+`,
+		FormatTOML: `
+[[classes]]
+name = "equities"
+weight = 0.6
+
+[[classes]]
+name = "bonds"
+weight = 0.4
+band = { relative = 0.1 }
+
+[[targets]]
+id = "878733"
+name = "Avanza Global"
+weight = 0.7
+class = "equities"
+band = { absolute = 0.02 }
+
+[[targets]]
+isin = "SE0000000000"
+weight = 0.3
+class = "bonds"
+restriction = "buy-only"
+maxWeight = 0.5
+`,
+	} {
+		p, err := Decode(strings.NewReader(input), format)
+		if err != nil {
+			t.Errorf("Decode(%s) error = %v", format, err)
+			continue
+		}
+		if got := p.Distributions(); !reflect.DeepEqual(want, got) {
+			t.Errorf("Decode(%s).Distributions() = %+v, want %+v", format, got, want)
+		}
+		classes := p.AssetClasses()
+		if want, got := 2, len(classes); want != got {
+			t.Errorf("Decode(%s).AssetClasses() has %d classes, want %d", format, got, want)
+			continue
+		}
+		if want, got := (&transfers.Tolerance{Relative: 0.1}), classes[1].Tolerance; !reflect.DeepEqual(want, got) {
+			t.Errorf("Decode(%s).AssetClasses()[1].Tolerance = %+v, want %+v", format, got, want)
+		}
+	}
+
+	if _, err := Decode(strings.NewReader(`{"targets": [{"name": "A", "restriction": "sell"}]}`), FormatJSON); err == nil {
+		t.Error("Decode() with unknown restriction succeeded, want error")
+	}
+}
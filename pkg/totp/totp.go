@@ -0,0 +1,68 @@
+// Package totp generates time-based one-time passwords as specified by RFC
+// 6238, as shown by authenticator apps.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Parameters of the codes, which are those of most authenticator apps.
+const (
+	// Step is the time that a code is valid for.
+	Step = 30 * time.Second
+	// Digits is the number of digits of a code.
+	Digits = 6
+)
+
+// ErrInvalidSecret is returned when a secret cannot be decoded.
+var ErrInvalidSecret = errors.New("totp: invalid secret")
+
+// DecodeSecret decodes a secret in base32, as it is shown when adding an
+// authenticator app, ignoring spaces, case and padding.
+func DecodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Join(strings.Fields(secret), ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSecret, err)
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("%w: empty", ErrInvalidSecret)
+	}
+	return key, nil
+}
+
+// Code returns the code of the base32 encoded secret at the given time.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := DecodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return generate(key, uint64(t.Unix())/uint64(Step/time.Second), Digits), nil
+}
+
+// generate returns the HMAC-SHA1 based one-time password of RFC 4226 for the
+// key and counter, with the given number of digits.
+func generate(key []byte, counter uint64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// Dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
@@ -0,0 +1,38 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGenerate(t *testing.T) {
+	// Test vectors of RFC 6238, appendix B, for SHA1.
+	key := []byte("12345678901234567890")
+	for _, tc := range []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	} {
+		if got := generate(key, uint64(tc.unix)/30, 8); tc.want != got {
+			t.Errorf("generate(%d) = %s, want %s", tc.unix, got, tc.want)
+		}
+	}
+
+	code, err := Code("gezd gnbv gy3t qojq gezd gnbv gy3t qojq", time.Unix(59, 0))
+	if err != nil {
+		t.Fatalf("Code() error = %v", err)
+	}
+	if want, got := "287082", code; want != got {
+		t.Errorf("Code() = %s, want %s", got, want)
+	}
+
+	if _, err := Code("not base32!", time.Unix(59, 0)); err == nil {
+		t.Error("Code() with invalid secret succeeded, want error")
+	}
+}
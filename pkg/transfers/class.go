@@ -0,0 +1,217 @@
+package transfers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// AssetClass is a class of assets with a target weight, which may be divided
+// into subclasses with target weights of their own.
+type AssetClass struct {
+	Name string
+	// Weight of the class relative to the other classes of its parent, e.g.
+	// 0.6 for 60 %
+	Weight float64
+	// Tolerance overrides the global tolerance band of the class
+	Tolerance *Tolerance
+	// Classes are the subclasses, if any
+	Classes []AssetClass
+}
+
+// ClassDeviation is the amount by which the current value of an asset class
+// exceeds its target value, like Deviation is for an instrument.
+type ClassDeviation struct {
+	// Class is the path of the class, e.g. "equities/global"
+	Class string
+	// Level is the depth of the class, starting at 0 for the top-level
+	// classes.
+	Level  int
+	Amount float64
+}
+
+// ErrAssetClass is returned when instruments and asset classes do not match.
+var ErrAssetClass = errors.New("invalid asset class")
+
+// classSeparator separates the names of the classes of a path.
+const classSeparator = "/"
+
+// classPaths returns the path of each class of the hierarchy in pre-order,
+// along with its level and its share of the whole, which is its weight
+// relative to its siblings times the share of its parent.
+func classPaths(classes []AssetClass) (paths []string, levels []int, shares map[string]float64, problems []error) {
+	shares = map[string]float64{}
+	var walk func(classes []AssetClass, parent string, level int, share float64)
+	walk = func(classes []AssetClass, parent string, level int, share float64) {
+		sum := 0.0
+		for _, c := range classes {
+			sum += c.Weight
+		}
+		for _, c := range classes {
+			path := c.Name
+			if parent != "" {
+				path = parent + classSeparator + c.Name
+			}
+			if c.Weight < 0 {
+				problems = append(problems, fmt.Errorf("%w for class %q: %g", ErrNegativeTarget, path, c.Weight))
+			}
+			paths, levels = append(paths, path), append(levels, level)
+			if sum > 0 {
+				shares[path] = share * c.Weight / sum
+			}
+			walk(c.Classes, path, level+1, shares[path])
+		}
+	}
+	walk(classes, "", 0, 1)
+	return paths, levels, shares, problems
+}
+
+// classTargets returns the distributions with the target of each instrument
+// set to its share of the target of its asset class, see Distribution.
+// AssetClass, which must be a class without subclasses. Within a class, the
+// targets of the instruments are weights relative to each other, which are
+// split evenly if they are all zero, so that the preferred instruments of the
+// class get the larger shares. It returns a *DistributionError if an
+// instrument is not in such a class, if a class with a target has no
+// instruments or if any class has a negative weight.
+func classTargets(classes []AssetClass, distributions []Distribution) ([]Distribution, error) {
+	paths, _, shares, problems := classPaths(classes)
+	leaves := map[string]bool{}
+	for i, path := range paths {
+		leaves[path] = i == len(paths)-1 || !strings.HasPrefix(paths[i+1], path+classSeparator)
+	}
+
+	sums, counts := map[string]float64{}, map[string]int{}
+	for _, dist := range distributions {
+		if !leaves[dist.AssetClass] {
+			problems = append(problems, fmt.Errorf("%w %q of %q", ErrAssetClass, dist.AssetClass, dist.InstrumentName))
+			continue
+		}
+		sums[dist.AssetClass] += dist.Distribution
+		counts[dist.AssetClass]++
+	}
+	for _, path := range paths {
+		if leaves[path] && shares[path] > 0 && counts[path] == 0 {
+			problems = append(problems, fmt.Errorf("%w %q: no instruments", ErrAssetClass, path))
+		}
+	}
+	if len(problems) > 0 {
+		return nil, &DistributionError{Problems: problems}
+	}
+
+	targets := make([]Distribution, len(distributions))
+	for i, dist := range distributions {
+		if sum := sums[dist.AssetClass]; sum != 0 {
+			dist.Distribution = shares[dist.AssetClass] * dist.Distribution / sum
+		} else {
+			dist.Distribution = shares[dist.AssetClass] / float64(counts[dist.AssetClass])
+		}
+		targets[i] = dist
+	}
+	return targets, nil
+}
+
+// classDeviations returns the deviation of each class of the hierarchy, which
+// is the sum of the deviations of the instruments in it and its subclasses.
+func classDeviations(classes []AssetClass, distributions []Distribution, balances map[string]float64) []ClassDeviation {
+	paths, levels, _, _ := classPaths(classes)
+	amounts := map[string]float64{}
+	for _, dist := range distributions {
+		class := dist.AssetClass
+		for class != "" {
+			amounts[class] += balances[dist.InstrumentName]
+			class = parentClass(class)
+		}
+	}
+
+	deviations := make([]ClassDeviation, len(paths))
+	for i, path := range paths {
+		deviations[i] = ClassDeviation{Class: path, Level: levels[i], Amount: amounts[path]}
+	}
+	return deviations
+}
+
+// classBounds holds the instruments of an asset class, including those of its
+// subclasses, and the bounds on the net amount to transfer out of them
+// together, see outflowBounds, which count as reaching the target of the
+// class within reach if it is to get as close to it as possible.
+type classBounds struct {
+	instruments []string
+	bounds      [2]float64
+	reach       [2]float64
+}
+
+// classRebalancing returns the bounds of each class of the hierarchy that
+// holds any instruments, where instrClass holds the class of each instrument
+// and balances and current the deviations and current values of the
+// instruments, like the bounds of the instruments outside any class. The
+// classes get the tolerance band of o unless they have their own.
+func classRebalancing(classes []AssetClass, instrClass map[string]string, balances, current map[string]float64, total float64, closest bool, o options) []classBounds {
+	tolerances := map[string]Tolerance{}
+	var walk func(classes []AssetClass, parent string)
+	walk = func(classes []AssetClass, parent string) {
+		for _, c := range classes {
+			path := c.Name
+			if parent != "" {
+				path = parent + classSeparator + c.Name
+			}
+			if c.Tolerance != nil {
+				tolerances[path] = *c.Tolerance
+			}
+			walk(c.Classes, path)
+		}
+	}
+	walk(classes, "")
+
+	instruments := make([]string, 0, len(instrClass))
+	for instr := range instrClass {
+		instruments = append(instruments, instr)
+	}
+	sort.Strings(instruments)
+	members, devs, values := map[string][]string{}, map[string]float64{}, map[string]float64{}
+	for _, instr := range instruments {
+		for class := instrClass[instr]; class != ""; class = parentClass(class) {
+			members[class] = append(members[class], instr)
+			devs[class] += balances[instr]
+			values[class] += current[instr]
+		}
+	}
+
+	paths, _, _, _ := classPaths(classes)
+	var rebalancing []classBounds
+	for _, path := range paths {
+		if len(members[path]) == 0 {
+			continue
+		}
+		tolerance, ok := tolerances[path]
+		if !ok {
+			tolerance = o.tolerance
+		}
+		value, target := values[path], values[path]-devs[path]
+		band := tolerance.width(target, total)
+		c := classBounds{instruments: members[path]}
+		if closest {
+			edge := outflowBounds(value, target, band, RebalanceToEdge)
+			c.bounds = [2]float64{math.Min(edge[0], 0), math.Max(edge[1], 0)}
+			c.reach = [2]float64{devs[path], devs[path]}
+			if o.rebalanceMode == RebalanceToEdge {
+				c.reach = edge
+			}
+		} else {
+			c.bounds = outflowBounds(value, target, band, o.rebalanceMode)
+		}
+		rebalancing = append(rebalancing, c)
+	}
+	return rebalancing
+}
+
+// parentClass returns the path of the parent of a class, or the empty string
+// for a top-level class.
+func parentClass(path string) string {
+	if i := strings.LastIndex(path, classSeparator); i >= 0 {
+		return path[:i]
+	}
+	return ""
+}
@@ -0,0 +1,50 @@
+//go:build clp
+// +build clp
+
+package transfers
+
+import "github.com/lanl/clp"
+
+// defaultSolver is the COIN-OR CLP solver when built with the clp tag.
+var defaultSolver solver = clpSolver{}
+
+// clpSolver solves linear programs with the COIN-OR CLP library.
+type clpSolver struct{}
+
+func (clpSolver) solve(p *problem) ([]float64, float64, lpStatus) {
+	matrix := clp.NewPackedMatrix()
+	for _, col := range p.cols {
+		nonzeros := make([]clp.Nonzero, len(col))
+		for i, nz := range col {
+			nonzeros[i] = clp.Nonzero{Index: nz.row, Value: nz.val}
+		}
+		matrix.AppendColumn(nonzeros)
+	}
+	matrix.SetDimensions(len(p.rowBounds), len(p.cols))
+
+	colBounds := make([]clp.Bounds, len(p.colBounds))
+	for j, b := range p.colBounds {
+		colBounds[j] = clp.Bounds{Lower: b[0], Upper: b[1]}
+	}
+	rowBounds := make([]clp.Bounds, len(p.rowBounds))
+	for i, b := range p.rowBounds {
+		rowBounds[i] = clp.Bounds{Lower: b[0], Upper: b[1]}
+	}
+
+	simplex := clp.NewSimplex()
+	simplex.LoadProblem(matrix, colBounds, p.obj, rowBounds, nil)
+	simplex.SetOptimizationDirection(clp.Minimize)
+
+	var status lpStatus
+	switch simplex.Primal(clp.NoValuesPass, clp.NoStartFinishOptions) {
+	case clp.Optimal:
+		status = lpOptimal
+	case clp.Infeasible:
+		status = lpInfeasible
+	case clp.Unbounded:
+		status = lpUnbounded
+	default:
+		status = lpIterationLimit
+	}
+	return simplex.PrimalColumnSolution(), simplex.ObjectiveValue(), status
+}
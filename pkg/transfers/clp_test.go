@@ -0,0 +1,70 @@
+//go:build clp
+// +build clp
+
+package transfers
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// TestSolvers_Equivalent asserts that the pure Go and the CLP solvers produce
+// equivalent plans, i.e. plans that are equally good by the objective and
+// that reach the same values unless tolerance bands leave room for choice.
+func TestSolvers_Equivalent(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	for n := 2; n <= 12; n++ {
+		positions := make([]Position, n)
+		distributions := make([]Distribution, n)
+		for i := range positions {
+			name := fmt.Sprintf("%c fund", 'A'+i)
+			positions[i] = Position{
+				ID:         name,
+				Instrument: Fund{BaseInstrument{Name: name}},
+				Value:      Value{Value: math.Round(1000 * rnd.Float64())},
+			}
+			distributions[i] = Distribution{InstrumentName: name, Distribution: 1 / float64(n)}
+		}
+
+		for _, tt := range []struct {
+			opts   []Option
+			count  bool // whether the number of transfers is minimized
+			unique bool // whether the values reached are unique
+		}{
+			{nil, false, true},
+			{[]Option{WithObjective(MinimizeCount)}, true, true},
+			{[]Option{WithTolerance(Tolerance{Relative: 0.1}), WithRebalanceMode(RebalanceToEdge)}, false, false},
+			{[]Option{WithDeposit(500)}, false, true},
+			{[]Option{WithWithdrawal(500)}, false, true},
+			{[]Option{WithDeposit(500), WithSwitches()}, false, true},
+		} {
+			opts := tt.opts
+			simplexPlan, err := Calculate(positions, distributions, append(opts, withSolver(simplexSolver{}))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clpPlan, err := Calculate(positions, distributions, append(opts, withSolver(clpSolver{}))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want, got := len(clpPlan.Transfers), len(simplexPlan.Transfers); tt.count && want != got {
+				t.Errorf("%d instruments: len(Transfers) = %d, want %d", n, got, want)
+			}
+			if want, got := transferredAmount(clpPlan), transferredAmount(simplexPlan); !tt.count && math.Abs(want-got) > 1e-6 {
+				t.Errorf("%d instruments: transferred amount = %v, want %v", n, got, want)
+			}
+			if !tt.unique {
+				continue
+			}
+			want := applyTransfers(positions, clpPlan.Transfers)
+			for instr, got := range applyTransfers(positions, simplexPlan.Transfers) {
+				if math.Abs(want[instr]-got) > 1e-6 {
+					t.Errorf("%d instruments: value of %q = %v, want %v", n, instr, got, want[instr])
+				}
+			}
+		}
+	}
+}
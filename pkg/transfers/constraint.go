@@ -0,0 +1,117 @@
+package transfers
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Restriction limits the directions in which an instrument may be
+// rebalanced.
+type Restriction int
+
+// Supported restrictions.
+const (
+	// Unrestricted instruments may be both bought and sold.
+	Unrestricted Restriction = iota
+	// Locked instruments are neither bought nor sold.
+	Locked
+	// SellOnly instruments are never bought.
+	SellOnly
+	// BuyOnly instruments are never sold.
+	BuyOnly
+)
+
+func (r Restriction) String() string {
+	switch r {
+	case Locked:
+		return "locked"
+	case SellOnly:
+		return "sell only"
+	case BuyOnly:
+		return "buy only"
+	default:
+		return "unrestricted"
+	}
+}
+
+// Constraint limits how an instrument may be rebalanced.
+type Constraint struct {
+	Restriction Restriction
+	// Smallest decimal percentage of the total value that the instrument
+	// may make up after rebalancing, e.g. 0.05
+	MinWeight float64
+	// Largest decimal percentage of the total value that the instrument
+	// may make up after rebalancing, e.g. 0.30, or zero for no limit
+	MaxWeight float64
+}
+
+func (c Constraint) String() string {
+	var parts []string
+	if c.Restriction != Unrestricted {
+		parts = append(parts, c.Restriction.String())
+	}
+	if c.MinWeight != 0 {
+		parts = append(parts, fmt.Sprintf("min weight %.2f %%", 100*c.MinWeight))
+	}
+	if c.MaxWeight != 0 {
+		parts = append(parts, fmt.Sprintf("max weight %.2f %%", 100*c.MaxWeight))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// outflowLimits returns the lower and upper limits that the constraint puts
+// on the net amount transferred out of an instrument with the given current
+// value, out of the given total value after rebalancing.
+func (c Constraint) outflowLimits(current, total float64) [2]float64 {
+	limits := [2]float64{math.Inf(-1), math.Inf(1)}
+	switch c.Restriction {
+	case Locked:
+		limits = [2]float64{0, 0}
+	case SellOnly:
+		limits[0] = 0
+	case BuyOnly:
+		limits[1] = 0
+	}
+	if c.MinWeight != 0 {
+		limits[1] = math.Min(limits[1], current-c.MinWeight*total)
+	}
+	if c.MaxWeight != 0 {
+		limits[0] = math.Max(limits[0], current-c.MaxWeight*total)
+	}
+	return limits
+}
+
+// clamp returns the bounds moved inside the limits.
+func clamp(bounds, limits [2]float64) [2]float64 {
+	for i := range bounds {
+		bounds[i] = math.Max(limits[0], math.Min(limits[1], bounds[i]))
+	}
+	return bounds
+}
+
+// ConstraintError is returned when the constraints of the instruments cannot
+// all be satisfied at once.
+type ConstraintError struct {
+	// Constraints that together cannot be satisfied per instrument
+	Constraints map[string]Constraint
+}
+
+func (e *ConstraintError) Error() string {
+	instruments := make([]string, 0, len(e.Constraints))
+	for instr := range e.Constraints {
+		instruments = append(instruments, instr)
+	}
+	sort.Strings(instruments)
+
+	var b strings.Builder
+	b.WriteString("constraints cannot be satisfied:")
+	for i, instr := range instruments {
+		if i > 0 {
+			b.WriteString(";")
+		}
+		fmt.Fprintf(&b, " %s (%s)", instr, e.Constraints[instr])
+	}
+	return b.String()
+}
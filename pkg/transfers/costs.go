@@ -0,0 +1,99 @@
+package transfers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// costWildcard matches any instrument in a cost table.
+const costWildcard = "*"
+
+// ReadTransferCosts reads a table of transfer costs in CSV format, with one
+// "from,to,cost" record per pair of instruments. Either instrument may be *
+// to match any instrument, in which case records for specific instruments
+// take precedence. Transfers that match no record are free.
+func ReadTransferCosts(r io.Reader) (TransferCost, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 3
+	reader.Comment = '#'
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("reading transfer costs: %s", err)
+	}
+
+	costs := map[[2]string]float64{}
+	for _, record := range records {
+		cost, err := strconv.ParseFloat(record[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing transfer cost from %q to %q: %s", record[0], record[1], err)
+		}
+		if cost < 0 {
+			return nil, fmt.Errorf("%w from %q to %q: %g", ErrTransferCost, record[0], record[1], cost)
+		}
+		costs[[2]string{record[0], record[1]}] = cost
+	}
+
+	return func(from, to string) float64 {
+		for _, pair := range [][2]string{
+			{from, to},
+			{from, costWildcard},
+			{costWildcard, to},
+			{costWildcard, costWildcard},
+		} {
+			if cost, ok := costs[pair]; ok {
+				return cost
+			}
+		}
+		return 0
+	}, nil
+}
+
+// ReadLocationCosts reads a table of location costs in CSV format, with one
+// "account type,instrument,cost" record per type of account and instrument or
+// asset class, where a cost of inf means that the instrument may not be
+// bought in such accounts. Either the account type or the instrument may be *
+// to match any, in which case records for specific account types take
+// precedence, and then records for specific instruments over those for asset
+// classes, and those for subclasses over those for their parents, e.g.
+// "equities/global" over "equities". Instruments that match no record are
+// free to hold anywhere.
+func ReadLocationCosts(r io.Reader) (LocationCost, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 3
+	reader.Comment = '#'
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("reading location costs: %s", err)
+	}
+
+	costs := map[[2]string]float64{}
+	for _, record := range records {
+		cost, err := strconv.ParseFloat(record[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing location cost of %q in %q: %s", record[1], record[0], err)
+		}
+		if cost < 0 || math.IsNaN(cost) {
+			return nil, fmt.Errorf("%w of %q in %q: %g", ErrLocationCost, record[1], record[0], cost)
+		}
+		costs[[2]string{record[0], record[1]}] = cost
+	}
+
+	return func(accountType, instrument, assetClass string) float64 {
+		keys := []string{instrument}
+		for class := assetClass; class != ""; class = parentClass(class) {
+			keys = append(keys, class)
+		}
+		keys = append(keys, costWildcard)
+		for _, t := range []string{accountType, costWildcard} {
+			for _, key := range keys {
+				if cost, ok := costs[[2]string{t, key}]; ok {
+					return cost
+				}
+			}
+		}
+		return 0
+	}, nil
+}
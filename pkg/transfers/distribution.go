@@ -0,0 +1,123 @@
+package transfers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// DistributionMode is how problems with the target distribution are handled.
+type DistributionMode int
+
+// Supported distribution modes.
+const (
+	// DistributionAsIs uses the targets as given, except that duplicate
+	// targets are merged, and lists any problems with them in
+	// Plan.DistributionProblems.
+	DistributionAsIs DistributionMode = iota
+	// DistributionNormalize merges duplicate targets and scales the targets
+	// to sum to 1. Negative targets are still refused.
+	DistributionNormalize
+	// DistributionStrict refuses to calculate a plan for a target
+	// distribution with problems.
+	DistributionStrict
+)
+
+// Problems that may be found with a target distribution.
+var (
+	ErrDuplicateTarget = errors.New("duplicate target")
+	ErrNegativeTarget  = errors.New("negative target")
+	ErrTargetSum       = errors.New("targets do not sum to 1")
+)
+
+// DistributionError is returned when a target distribution has problems that
+// may not be, or cannot be, normalized away.
+type DistributionError struct {
+	Problems []error
+}
+
+func (e *DistributionError) Error() string {
+	problems := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		problems[i] = p.Error()
+	}
+	return "invalid target distribution: " + strings.Join(problems, "; ")
+}
+
+// Is reports whether any of the problems is target.
+func (e *DistributionError) Is(target error) bool {
+	for _, p := range e.Problems {
+		if errors.Is(p, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// distributionTol is how far from 1 the targets may sum.
+const distributionTol = 1e-6
+
+// ValidateDistributions returns the problems found with the distributions, i.e.
+// instruments with more than one target, negative targets and targets that do
+// not sum to 1.
+func ValidateDistributions(distributions []Distribution) []error {
+	var problems []error
+	seen, sum := map[string]bool{}, 0.0
+	for _, dist := range distributions {
+		if seen[dist.InstrumentName] {
+			problems = append(problems, fmt.Errorf("%w for %q", ErrDuplicateTarget, dist.InstrumentName))
+		}
+		seen[dist.InstrumentName] = true
+		if dist.Distribution < 0 {
+			problems = append(problems, fmt.Errorf("%w for %q: %g", ErrNegativeTarget, dist.InstrumentName, dist.Distribution))
+		}
+		sum += dist.Distribution
+	}
+	if math.Abs(sum-1) > distributionTol {
+		problems = append(problems, fmt.Errorf("%w: %g", ErrTargetSum, sum))
+	}
+	return problems
+}
+
+// mergeDistributions returns the distributions with the targets of each
+// instrument summed into its first target.
+func mergeDistributions(distributions []Distribution) []Distribution {
+	index := map[string]int{}
+	var merged []Distribution
+	for _, dist := range distributions {
+		if i, ok := index[dist.InstrumentName]; ok {
+			merged[i].Distribution += dist.Distribution
+			continue
+		}
+		index[dist.InstrumentName] = len(merged)
+		merged = append(merged, dist)
+	}
+	return merged
+}
+
+// normalizeDistributions merges the targets of each instrument and scales them
+// to sum to 1. It returns a *DistributionError if any target is negative or
+// if they sum to zero.
+func normalizeDistributions(distributions []Distribution) ([]Distribution, error) {
+	var problems []error
+	sum := 0.0
+	for _, dist := range distributions {
+		if dist.Distribution < 0 {
+			problems = append(problems, fmt.Errorf("%w for %q: %g", ErrNegativeTarget, dist.InstrumentName, dist.Distribution))
+		}
+		sum += dist.Distribution
+	}
+	normalized := mergeDistributions(distributions)
+	if sum <= 0 {
+		problems = append(problems, fmt.Errorf("%w: %g", ErrTargetSum, sum))
+	}
+	if len(problems) > 0 {
+		return nil, &DistributionError{Problems: problems}
+	}
+
+	for i := range normalized {
+		normalized[i].Distribution /= sum
+	}
+	return normalized, nil
+}
@@ -0,0 +1,96 @@
+package transfers
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// RateSource provides exchange rates between currencies.
+type RateSource interface {
+	// Rate returns what one unit of currency from is worth in currency to.
+	Rate(from, to string) (float64, error)
+}
+
+// ErrNoRate is returned when there is no exchange rate between two
+// currencies.
+var ErrNoRate = errors.New("no exchange rate")
+
+// Rates is a RateSource of fixed exchange rates per pair of currencies, from
+// which the inverse rates are implied.
+type Rates map[[2]string]float64
+
+// Rate implements RateSource.
+func (r Rates) Rate(from, to string) (float64, error) {
+	if from == to {
+		return 1, nil
+	}
+	if rate, ok := r[[2]string{from, to}]; ok {
+		return rate, nil
+	}
+	if rate, ok := r[[2]string{to, from}]; ok {
+		return 1 / rate, nil
+	}
+	return 0, fmt.Errorf("%w from %s to %s", ErrNoRate, from, to)
+}
+
+// ReadRates reads exchange rates in CSV format, with one "from,to,rate" record
+// per pair of currencies, e.g. "USD,SEK,10.5" for one USD being worth 10.5
+// SEK.
+func ReadRates(r io.Reader) (Rates, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 3
+	reader.Comment = '#'
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("reading exchange rates: %s", err)
+	}
+
+	rates := Rates{}
+	for _, record := range records {
+		rate, err := strconv.ParseFloat(record[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing exchange rate from %s to %s: %s", record[0], record[1], err)
+		}
+		if !(rate > 0) {
+			return nil, fmt.Errorf("invalid exchange rate from %s to %s: %g", record[0], record[1], rate)
+		}
+		rates[[2]string{record[0], record[1]}] = rate
+	}
+	return rates, nil
+}
+
+// convertPositions returns the positions with their values converted from
+// their units to the base currency, along with what one unit of the currency
+// of each instrument is worth in the base currency. Positions without a unit
+// are taken to be in the currency of their instruments, and instruments
+// without a currency to be in the base currency.
+func convertPositions(positions []Position, base string, rates RateSource) ([]Position, map[string]float64, error) {
+	converted := make([]Position, len(positions))
+	instrRates := map[string]float64{}
+	for i, pos := range positions {
+		currency := pos.Instrument.Currency
+		if currency == "" {
+			currency = base
+		}
+		unit := pos.Value.Unit
+		if unit == "" {
+			unit = currency
+		}
+
+		rate, err := rates.Rate(unit, base)
+		if err != nil {
+			return nil, nil, err
+		}
+		pos.Value.Value *= rate
+		pos.Value.Unit = base
+		converted[i] = pos
+
+		if instrRates[pos.Instrument.Name], err = rates.Rate(currency, base); err != nil {
+			return nil, nil, err
+		}
+	}
+	return converted, instrRates, nil
+}
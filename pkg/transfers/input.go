@@ -10,9 +10,16 @@ type Position struct {
 	Value      Value
 }
 
+// IsCash reports whether the position is uninvested money.
+func (p Position) IsCash() bool {
+	return p.Instrument.Type == TypeCash
+}
+
 type Account struct {
 	ID   string
 	Name string
+	// Type of the account, e.g. "ISK", see WithLocationCost
+	Type string
 }
 
 // type Instrument interface {
@@ -22,6 +29,8 @@ type Account struct {
 // }
 
 type BaseInstrument struct {
+	// Broker specific identifier of the instrument
+	ID       string
 	Name     string
 	Currency string
 	ISIN     string
@@ -40,6 +49,16 @@ type BaseInstrument struct {
 // 	return i.isin
 // }
 
+// Instrument types.
+const (
+	// TypeCash is the type of the instrument of positions that are
+	// uninvested money.
+	TypeCash = "CASH"
+)
+
+// CashName is the name of the instrument of cash positions.
+const CashName = "Cash"
+
 type Fund struct {
 	BaseInstrument
 }
@@ -52,10 +71,22 @@ type Value struct {
 }
 
 type Distribution struct {
+	// Broker specific identifier of the instrument, see BaseInstrument.ID
+	InstrumentID string
+	// ISIN of the instrument
+	ISIN string
 	// Human-readable name of the instrument
 	InstrumentName string
 	// ???
 	Amount int
 	// Decimal percentage of the instrument, e.g. 0.15
 	Distribution float64
+	// Tolerance overrides the global tolerance band of the instrument
+	Tolerance *Tolerance
+	// Constraint limits how the instrument may be rebalanced, unless
+	// overridden by WithConstraints
+	Constraint *Constraint
+	// Path of the asset class of the instrument, e.g. "equities/global", see
+	// WithAssetClasses and WithLocationCost
+	AssetClass string
 }
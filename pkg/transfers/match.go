@@ -0,0 +1,90 @@
+package transfers
+
+import "fmt"
+
+// matchDistributions matches each distribution to a position by instrument ID,
+// then by ISIN and, as a last resort, by name. It returns the distributions
+// named after the instruments of the positions they match, along with the
+// names of the instruments that are only found among the distributions or
+// only among the (non-cash) positions.
+func matchDistributions(positions []Position, distributions []Distribution) ([]Distribution, []string) {
+	byID, byISIN, byName := map[string]string{}, map[string]string{}, map[string]string{}
+	for _, pos := range positions {
+		instr := pos.Instrument
+		if instr.ID != "" {
+			byID[instr.ID] = instr.Name
+		}
+		if instr.ISIN != "" {
+			byISIN[instr.ISIN] = instr.Name
+		}
+		byName[instr.Name] = instr.Name
+	}
+
+	var unmatched []string
+	matched := map[string]bool{}
+	result := make([]Distribution, len(distributions))
+	for i, dist := range distributions {
+		name, ok := byID[dist.InstrumentID]
+		if !ok {
+			name, ok = byISIN[dist.ISIN]
+		}
+		if !ok {
+			name, ok = byName[dist.InstrumentName]
+		}
+		if ok {
+			dist.InstrumentName = name
+			matched[name] = true
+		} else {
+			unmatched = append(unmatched, dist.InstrumentName)
+		}
+		result[i] = dist
+	}
+
+	for _, pos := range positions {
+		name := pos.Instrument.Name
+		if !matched[name] && !pos.IsCash() {
+			unmatched = append(unmatched, name)
+			matched[name] = true
+		}
+	}
+	return result, unmatched
+}
+
+// distinctInstruments returns the positions with the instruments that have
+// the same name but different identities, i.e. IDs or else ISINs, named
+// after their identities too, e.g. "Global (878733)", so that they are not
+// taken for the same instrument. Instruments without an identity keep their
+// names.
+func distinctInstruments(positions []Position) []Position {
+	identity := func(instr BaseInstrument) string {
+		if instr.ID != "" {
+			return instr.ID
+		}
+		return instr.ISIN
+	}
+	identities := map[string]map[string]bool{}
+	for _, pos := range positions {
+		if id := identity(pos.Instrument.BaseInstrument); id != "" && !pos.IsCash() {
+			if identities[pos.Instrument.Name] == nil {
+				identities[pos.Instrument.Name] = map[string]bool{}
+			}
+			identities[pos.Instrument.Name][id] = true
+		}
+	}
+
+	var distinct []Position
+	for i, pos := range positions {
+		id := identity(pos.Instrument.BaseInstrument)
+		if id == "" || pos.IsCash() || len(identities[pos.Instrument.Name]) < 2 {
+			continue
+		}
+		if distinct == nil {
+			distinct = append([]Position(nil), positions...)
+		}
+		distinct[i].Instrument.Name = fmt.Sprintf("%s (%s)", pos.Instrument.Name, id)
+	}
+	if distinct == nil {
+		return positions
+	}
+	return distinct
+}
@@ -0,0 +1,200 @@
+package transfers
+
+import (
+	"math"
+	"time"
+)
+
+// Tolerances and limits used when solving mixed-integer programs.
+const (
+	integerTol = 1e-9
+	feasTol    = 1e-9 // relative to the row activity
+	maxNodes   = 1000
+)
+
+// mip is a mixed-integer program, i.e. a linear program in which some of the
+// columns may only take on integer values.
+type mip struct {
+	problem *problem
+	integer []bool
+	solver  solver
+	// incumbent is a solution known beforehand, if any, which is only
+	// started from if feasible.
+	incumbent []float64
+	// deadline is when to stop branching, if set.
+	deadline time.Time
+}
+
+// solve minimizes the objective of the program by branch and bound over its
+// linear relaxations, starting from the incumbent and from a dive from the
+// root relaxation. If the node limit or the deadline is reached, the best
+// solution found so far is returned, or lpIterationLimit if there is none.
+func (p mip) solve() ([]float64, lpStatus) {
+	var best []float64
+	bestObj := math.Inf(1)
+	if p.incumbent != nil {
+		if incumbent, obj, ok := p.roundUp(p.incumbent, p.problem.colBounds); ok {
+			best, bestObj = incumbent, obj
+		}
+	}
+	noSolution := lpInfeasible
+
+	stack := [][][2]float64{p.problem.colBounds}
+	for nodes := 0; len(stack) > 0; nodes++ {
+		if nodes == maxNodes || nodes > 0 && !p.deadline.IsZero() && time.Now().After(p.deadline) {
+			noSolution = lpIterationLimit
+			break
+		}
+		bounds := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		soln, obj, status := p.solver.solve(p.withColBounds(bounds))
+		switch status {
+		case lpOptimal:
+		case lpUnbounded:
+			return nil, lpUnbounded
+		case lpIterationLimit:
+			noSolution = lpIterationLimit
+			continue
+		default:
+			continue
+		}
+		if obj >= bestObj-integerTol*math.Abs(bestObj) {
+			continue
+		}
+
+		if rounded, roundedObj, ok := p.roundUp(soln, bounds); ok && roundedObj < bestObj {
+			best, bestObj = rounded, roundedObj
+		} else if nodes == 0 {
+			if dived, divedObj, ok := p.dive(soln, bounds); ok && divedObj < bestObj {
+				best, bestObj = dived, divedObj
+			}
+		}
+
+		branch := p.mostFractional(soln)
+		if branch < 0 {
+			best, bestObj = soln, obj
+			continue
+		}
+
+		down := append([][2]float64(nil), bounds...)
+		down[branch][1] = math.Floor(soln[branch])
+		up := append([][2]float64(nil), bounds...)
+		up[branch][0] = math.Ceil(soln[branch])
+		stack = append(stack, up, down)
+	}
+
+	if best == nil {
+		return nil, noSolution
+	}
+
+	// Polish the solution by solving for the continuous variables once more
+	// with the integer variables fixed to their rounded values.
+	fixed := append([][2]float64(nil), p.problem.colBounds...)
+	for i, integer := range p.integer {
+		if integer {
+			v := math.Round(best[i])
+			fixed[i] = [2]float64{v, v}
+		}
+	}
+	if soln, _, status := p.solver.solve(p.withColBounds(fixed)); status == lpOptimal {
+		return soln, lpOptimal
+	}
+	return best, lpOptimal
+}
+
+// mostFractional returns the index of the integer variable whose value is the
+// farthest from an integer, or -1 if all integer variables are integral.
+func (p mip) mostFractional(soln []float64) int {
+	branch, dist := -1, integerTol
+	for i, integer := range p.integer {
+		if !integer {
+			continue
+		}
+		if d := math.Abs(soln[i] - math.Round(soln[i])); d > dist {
+			branch, dist = i, d
+		}
+	}
+	return branch
+}
+
+// roundUp rounds each integer variable in soln up to the closest integer and
+// reports whether the result is feasible along with its objective value.
+func (p mip) roundUp(soln []float64, bounds [][2]float64) ([]float64, float64, bool) {
+	rounded := append([]float64(nil), soln...)
+	for i, v := range rounded {
+		if p.integer[i] {
+			rounded[i] = math.Ceil(v - integerTol)
+			if rounded[i] > bounds[i][1] {
+				return nil, 0, false
+			}
+		} else if tol := feasTol * math.Max(1, math.Abs(v)); v < bounds[i][0]-tol || v > bounds[i][1]+tol {
+			return nil, 0, false
+		}
+	}
+
+	for i, activity := range p.problem.activities(rounded) {
+		lb, ub := p.problem.rowBounds[i][0], p.problem.rowBounds[i][1]
+		if tol := feasTol * math.Max(1, math.Abs(activity)); activity < lb-tol || activity > ub+tol {
+			return nil, 0, false
+		}
+	}
+
+	return rounded, p.objective(rounded), true
+}
+
+// dive looks for a feasible solution from the relaxed one by rounding down
+// the integer variables that may not be rounded up without violating a row,
+// such as the indicators of amounts below a minimum transfer, and solving
+// the relaxation again until the solution may be rounded up. It reports
+// whether one was found along with its objective value.
+func (p mip) dive(soln []float64, bounds [][2]float64) ([]float64, float64, bool) {
+	bounds = append([][2]float64(nil), bounds...)
+	for {
+		if rounded, obj, ok := p.roundUp(soln, bounds); ok {
+			return rounded, obj, true
+		}
+
+		activities, fixed := p.problem.activities(soln), false
+		for j, integer := range p.integer {
+			up := math.Ceil(soln[j] - integerTol)
+			if !integer || up-soln[j] < integerTol {
+				continue
+			}
+			for _, nz := range p.problem.cols[j] {
+				activity := activities[nz.row] + nz.val*(up-soln[j])
+				lb, ub := p.problem.rowBounds[nz.row][0], p.problem.rowBounds[nz.row][1]
+				if tol := feasTol * math.Max(1, math.Abs(activity)); activity < lb-tol || activity > ub+tol {
+					down := math.Floor(soln[j])
+					bounds[j], fixed = [2]float64{down, down}, true
+					break
+				}
+			}
+		}
+		if !fixed {
+			return nil, 0, false
+		}
+
+		var status lpStatus
+		if soln, _, status = p.solver.solve(p.withColBounds(bounds)); status != lpOptimal {
+			return nil, 0, false
+		}
+	}
+}
+
+// objective returns the objective value of the given solution.
+func (p mip) objective(soln []float64) float64 {
+	obj := 0.0
+	for i, v := range soln {
+		obj += p.problem.obj[i] * v
+	}
+	return obj
+}
+
+// withColBounds returns the relaxation of the program with the given bounds
+// on its columns.
+func (p mip) withColBounds(bounds [][2]float64) *problem {
+	relaxation := *p.problem
+	relaxation.colBounds = bounds
+	return &relaxation
+}
@@ -0,0 +1,243 @@
+package transfers
+
+import (
+	"fmt"
+	"time"
+)
+
+// Option configures how a plan is calculated.
+type Option func(*options)
+
+type options struct {
+	objective     Objective
+	tolerance     Tolerance
+	rebalanceMode RebalanceMode
+	cashFlow      float64
+	cashFlowErr   error
+	allowSwitches bool
+	cashTarget    float64
+	transferCost  TransferCost
+	locationCost  LocationCost
+	constraints   map[string]Constraint
+	minTransfer   float64
+	timeLimit     time.Duration
+	rounding      bool
+	distMode      DistributionMode
+	assetClasses  []AssetClass
+	baseCurrency  string
+	rates         RateSource
+	solver        solver
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		objective: MinimizeAmount,
+		timeLimit: 2 * time.Second,
+		solver:    defaultSolver,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Objective is what the balancer minimizes when choosing among the sets of
+// transfers that rebalance the positions.
+type Objective int
+
+// Supported objectives.
+const (
+	// MinimizeAmount minimizes the total transferred amount.
+	MinimizeAmount Objective = iota
+	// MinimizeCount minimizes the number of transfers, using the total
+	// transferred amount as a tie-breaker. The fewest transfers take long
+	// to find among many instruments, so the fewest found within the time
+	// limit are taken, see WithTimeLimit.
+	MinimizeCount
+)
+
+// WithObjective sets the objective to minimize. It defaults to MinimizeAmount.
+func WithObjective(objective Objective) Option {
+	return func(o *options) {
+		o.objective = objective
+	}
+}
+
+// WithTolerance sets the tolerance band of all instruments that do not have
+// one of their own. It defaults to no tolerance at all.
+func WithTolerance(tolerance Tolerance) Option {
+	return func(o *options) {
+		o.tolerance = tolerance
+	}
+}
+
+// WithRebalanceMode sets how far instruments outside their tolerance bands
+// are rebalanced. It defaults to RebalanceToTarget.
+func WithRebalanceMode(mode RebalanceMode) Option {
+	return func(o *options) {
+		o.rebalanceMode = mode
+	}
+}
+
+// WithDeposit invests the given amount of money in addition to rebalancing
+// the positions. Calculate returns ErrCashFlow if it is negative.
+func WithDeposit(amount float64) Option {
+	return func(o *options) {
+		o.cashFlow, o.cashFlowErr = amount, nil
+		if !(amount >= 0) {
+			o.cashFlowErr = fmt.Errorf("%w: deposit of %g", ErrCashFlow, amount)
+		}
+	}
+}
+
+// WithWithdrawal makes up the given amount of money to withdraw in addition
+// to rebalancing the positions. Calculate returns ErrCashFlow if it is
+// negative.
+func WithWithdrawal(amount float64) Option {
+	return func(o *options) {
+		o.cashFlow, o.cashFlowErr = -amount, nil
+		if !(amount >= 0) {
+			o.cashFlowErr = fmt.Errorf("%w: withdrawal of %g", ErrCashFlow, amount)
+		}
+	}
+}
+
+// WithSwitches allows switches between instruments when money is deposited
+// or withdrawn, so that the targets are reached rather than only approached
+// with buys or sells.
+func WithSwitches() Option {
+	return func(o *options) {
+		o.allowSwitches = true
+	}
+}
+
+// WithCashTarget sets the target distribution of cash, e.g. 0.05, and scales
+// down the target distributions of the other instruments to make room for it.
+// Cash has no target by default, so that it is fully invested.
+func WithCashTarget(distribution float64) Option {
+	return func(o *options) {
+		o.cashTarget = distribution
+	}
+}
+
+// TransferCost returns the cost per amount transferred from one instrument to
+// another, e.g. 0.0025 for a courtage of 0.25 %. It must not be negative.
+// The from instrument is empty for deposits and the to instrument for
+// withdrawals.
+type TransferCost func(from, to string) float64
+
+// WithTransferCost sets the cost of transfers per pair of instruments and
+// makes the balancer minimize the total cost, using the total transferred
+// amount as a tie-breaker. By default, all transfers cost the same per
+// amount, so that the total transferred amount is minimized.
+func WithTransferCost(cost TransferCost) Option {
+	return func(o *options) {
+		o.transferCost = cost
+	}
+}
+
+// WithAssetClasses sets a hierarchy of target weights per asset class, e.g.
+// 60 % equities, divided into 70 % global and 30 % Swedish, and 40 % fixed
+// income. Each instrument then belongs to a class without subclasses, see
+// Distribution.AssetClass, and its Distribution is its weight relative to the
+// other instruments of that class. The plan holds the deviation of each
+// class, see Plan.ClassDeviations.
+//
+// The instruments are then rebalanced by class: the instruments of a class
+// are only traded as far as the class is outside its tolerance band, or as a
+// counterpart to another class, and then only towards their own targets, so
+// that the instruments furthest below their targets are bought and those
+// furthest above them sold. The tolerance bands of the classes are that of
+// WithTolerance unless set per class, and those of the instruments not in
+// effect.
+func WithAssetClasses(classes []AssetClass) Option {
+	return func(o *options) {
+		o.assetClasses = classes
+	}
+}
+
+// LocationCost returns the cost per amount held of an instrument, of the
+// given asset class if any, in an account of the given type, e.g. 0.01 for
+// holding bonds in an account whose returns are taxed. It must not be
+// negative, and is +Inf if the instrument may not be bought in such accounts.
+type LocationCost func(accountType, instrument, assetClass string) float64
+
+// WithLocationCost sets the cost of holding instruments per type of account,
+// see Account.Type, and makes the balancer move instruments between accounts
+// towards where they are cheapest to hold, as long as that is worth more
+// than the cost of transferring them, if any, see WithTransferCost. Transfers still
+// take place within the accounts and still reach the targets, which apply to
+// all accounts together. Cash may be held anywhere at no cost.
+func WithLocationCost(cost LocationCost) Option {
+	return func(o *options) {
+		o.locationCost = cost
+	}
+}
+
+// WithConstraints sets constraints on how instruments may be rebalanced, per
+// instrument name, which override those of the targets, see
+// Distribution.Constraint. Calculate returns ErrUnknownInstrument for names
+// that are neither among the positions nor the targets.
+func WithConstraints(constraints map[string]Constraint) Option {
+	return func(o *options) {
+		o.constraints = constraints
+	}
+}
+
+// WithMinTransfer sets the smallest amount to transfer. Instruments that
+// would need smaller transfers to reach their targets get as close to them
+// as larger transfers allow, or as those found within the time limit do, see
+// WithTimeLimit.
+func WithMinTransfer(amount float64) Option {
+	return func(o *options) {
+		o.minTransfer = amount
+	}
+}
+
+// WithTimeLimit sets how long to look for the fewest transfers, see
+// MinimizeCount, or for the closest transfers of at least the minimum
+// amount, see WithMinTransfer, before taking the best ones found so far. The
+// time it takes to find the best ones grows quickly with the number of
+// instruments. It defaults to 2 seconds.
+func WithTimeLimit(limit time.Duration) Option {
+	return func(o *options) {
+		o.timeLimit = limit
+	}
+}
+
+// WithRounding rounds the transferred amounts to the decimal precision of the
+// positions, i.e. to whole units unless the values of all positions have
+// decimals. Each instrument then ends up within one unit of its target.
+// Deposits are rounded down and withdrawals up to whole units.
+func WithRounding() Option {
+	return func(o *options) {
+		o.rounding = true
+	}
+}
+
+// WithDistributionMode sets how problems with the target distribution are
+// handled. It defaults to DistributionAsIs.
+func WithDistributionMode(mode DistributionMode) Option {
+	return func(o *options) {
+		o.distMode = mode
+	}
+}
+
+// WithBaseCurrency converts the values of all positions into the given
+// currency using the rates, so that positions in different currencies may be
+// rebalanced together. Amounts, such as of deposits and minimum transfers, are
+// then in the base currency, and transfers are also given in the currencies
+// of their instruments.
+func WithBaseCurrency(currency string, rates RateSource) Option {
+	return func(o *options) {
+		o.baseCurrency, o.rates = currency, rates
+	}
+}
+
+// withSolver sets the linear programming solver to use. It defaults to the
+// pure Go simplex solver, or to COIN-OR CLP if built with the clp tag.
+func withSolver(s solver) Option {
+	return func(o *options) {
+		o.solver = s
+	}
+}
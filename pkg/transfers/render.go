@@ -0,0 +1,370 @@
+package transfers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Format is an output format for plans.
+type Format string
+
+// Supported output formats.
+const (
+	FormatText     Format = "text"
+	FormatJSON     Format = "json"
+	FormatCSV      Format = "csv"
+	FormatMarkdown Format = "markdown"
+)
+
+// Write writes the plan to w in the given format.
+func Write(w io.Writer, plan *Plan, format Format) error {
+	switch format {
+	case FormatText:
+		return WriteText(w, plan)
+	case FormatJSON:
+		return WriteJSON(w, plan)
+	case FormatCSV:
+		return WriteCSV(w, plan)
+	case FormatMarkdown:
+		return WriteMarkdown(w, plan)
+	default:
+		return fmt.Errorf("unknown output format: %q", format)
+	}
+}
+
+// WriteText writes a human-readable rendering of the plan to w.
+func WriteText(w io.Writer, plan *Plan) error {
+	var b strings.Builder
+
+	accounts := accountNames(plan)
+	fmt.Fprintf(&b, "# Current positions (# %d)\n", len(plan.Positions))
+	for _, p := range plan.Positions {
+		fmt.Fprintf(&b, "%s%-45s: %10.2f %s\n", accountPrefix(accounts, p.Account.ID), p.Instrument.Name, p.Value.Value, p.Value.Unit)
+	}
+	fmt.Fprintln(&b)
+
+	if plan.CashFlow != 0 {
+		fmt.Fprintf(&b, "# Cash flow: %.2f\n\n", plan.CashFlow)
+	}
+
+	fmt.Fprintf(&b, "# Target distribution (%f %%)\n", 100*distributionSum(plan))
+	for _, d := range plan.Distributions {
+		fmt.Fprintf(&b, "%-45s: %6.2f %%\n", d.InstrumentName, 100*d.Distribution)
+	}
+	fmt.Fprintln(&b)
+
+	fmt.Fprintf(&b, "# Calculated deviations (∑ %f)\n", deviationSum(plan))
+	for _, d := range plan.Deviations {
+		fmt.Fprintf(&b, "%-45s: %10.2f", d.InstrumentName, d.Amount)
+		if d.Band > 0 {
+			fmt.Fprintf(&b, "   (± %.2f)", d.Band)
+		}
+		fmt.Fprintln(&b)
+	}
+	fmt.Fprintln(&b)
+
+	if len(plan.ClassDeviations) > 0 {
+		fmt.Fprintf(&b, "# Calculated deviations per asset class\n")
+		for _, d := range plan.ClassDeviations {
+			name := strings.Repeat("  ", d.Level) + d.Class[strings.LastIndex(d.Class, classSeparator)+1:]
+			fmt.Fprintf(&b, "%-45s: %10.2f\n", name, d.Amount)
+		}
+		fmt.Fprintln(&b)
+	}
+
+	fmt.Fprintf(&b, "# Calculated transfers (# %d)\n", len(plan.Transfers))
+	for _, t := range plan.Transfers {
+		from, to := transferEnds(t)
+		fmt.Fprintf(&b, "%s%-45s -> %-45s : %10.2f   (%20.16f %%)", accountPrefix(accounts, t.Account), from, to, t.Amount, 100*t.Volume)
+		if plan.BaseCurrency != "" {
+			fmt.Fprintf(&b, "   [%.2f %s -> %.2f %s]", t.FromAmount, t.FromCurrency, t.ToAmount, t.ToCurrency)
+		}
+		fmt.Fprintln(&b)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// jsonPlan is the schema of plans written as JSON.
+type jsonPlan struct {
+	Positions  []jsonPosition  `json:"positions"`
+	CashFlow   float64         `json:"cashFlow"`
+	Targets    []jsonTarget    `json:"targets"`
+	Deviations []jsonDeviation `json:"deviations"`
+	Transfers  []jsonTransfer  `json:"transfers"`
+	Unmatched  []string        `json:"unmatched,omitempty"`
+	Problems   []string        `json:"distributionProblems,omitempty"`
+	Currency   string          `json:"baseCurrency,omitempty"`
+
+	ClassDeviations []jsonClassDeviation `json:"classDeviations,omitempty"`
+}
+
+type jsonPosition struct {
+	Account    string  `json:"account,omitempty"`
+	Instrument string  `json:"instrument"`
+	Value      float64 `json:"value"`
+	Unit       string  `json:"unit"`
+}
+
+type jsonTarget struct {
+	Instrument   string  `json:"instrument"`
+	Distribution float64 `json:"distribution"`
+}
+
+type jsonDeviation struct {
+	Instrument string  `json:"instrument"`
+	Amount     float64 `json:"amount"`
+	Band       float64 `json:"band"`
+}
+
+type jsonClassDeviation struct {
+	Class  string  `json:"class"`
+	Level  int     `json:"level"`
+	Amount float64 `json:"amount"`
+}
+
+type jsonTransfer struct {
+	Kind    string  `json:"kind"`
+	Account string  `json:"account,omitempty"`
+	From    string  `json:"from"`
+	To      string  `json:"to"`
+	Amount  float64 `json:"amount"`
+	Volume  float64 `json:"volume"`
+
+	FromAmount   float64 `json:"fromAmount,omitempty"`
+	FromCurrency string  `json:"fromCurrency,omitempty"`
+	ToAmount     float64 `json:"toAmount,omitempty"`
+	ToCurrency   string  `json:"toCurrency,omitempty"`
+}
+
+// WriteJSON writes the plan to w as a JSON object with the members positions,
+// cashFlow, targets, deviations and transfers.
+func WriteJSON(w io.Writer, plan *Plan) error {
+	out := jsonPlan{
+		Positions:  make([]jsonPosition, len(plan.Positions)),
+		CashFlow:   plan.CashFlow,
+		Targets:    make([]jsonTarget, len(plan.Distributions)),
+		Deviations: make([]jsonDeviation, len(plan.Deviations)),
+		Transfers:  make([]jsonTransfer, len(plan.Transfers)),
+		Unmatched:  plan.Unmatched,
+		Currency:   plan.BaseCurrency,
+	}
+	for _, p := range plan.DistributionProblems {
+		out.Problems = append(out.Problems, p.Error())
+	}
+	for i, p := range plan.Positions {
+		out.Positions[i] = jsonPosition{Account: p.Account.ID, Instrument: p.Instrument.Name, Value: p.Value.Value, Unit: p.Value.Unit}
+	}
+	for i, d := range plan.Distributions {
+		out.Targets[i] = jsonTarget{Instrument: d.InstrumentName, Distribution: d.Distribution}
+	}
+	for i, d := range plan.Deviations {
+		out.Deviations[i] = jsonDeviation{Instrument: d.InstrumentName, Amount: d.Amount, Band: d.Band}
+	}
+	for _, d := range plan.ClassDeviations {
+		out.ClassDeviations = append(out.ClassDeviations, jsonClassDeviation{Class: d.Class, Level: d.Level, Amount: d.Amount})
+	}
+	for i, t := range plan.Transfers {
+		out.Transfers[i] = jsonTransfer{
+			Kind:    t.Kind.String(),
+			Account: t.Account,
+			From:    t.From,
+			To:      t.To,
+			Amount:  t.Amount,
+			Volume:  t.Volume,
+
+			FromAmount:   t.FromAmount,
+			FromCurrency: t.FromCurrency,
+			ToAmount:     t.ToAmount,
+			ToCurrency:   t.ToCurrency,
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// csvHeader is the header row of plans written as CSV.
+var csvHeader = []string{"section", "instrument", "to", "amount", "unit", "share", "account", "kind", "band", "level", "message"}
+
+// WriteCSV writes the plan to w as CSV, with the same content as WriteJSON.
+// Every record has the columns listed in csvHeader, where section is one of
+// position, cashflow, target, deviation, class-deviation, transfer, unmatched
+// and problem. The instrument of a class-deviation is the path of its asset
+// class, and the message of a problem tells what is wrong with the target
+// distribution. Columns that do not apply to a section are left empty, such
+// as the instrument of a transfer from a deposit. If converted from a base
+// currency, each transfer is followed by a transfer-from and a transfer-to
+// record with the amounts in the currencies of the instruments.
+func WriteCSV(w io.Writer, plan *Plan) error {
+	records := [][]string{csvHeader}
+	record := func(fields ...string) {
+		records = append(records, append(fields, make([]string, len(csvHeader)-len(fields))...))
+	}
+
+	unit := planUnit(plan)
+	for _, p := range plan.Positions {
+		record("position", p.Instrument.Name, "", formatFloat(p.Value.Value), p.Value.Unit, "", p.Account.ID)
+	}
+	record("cashflow", "", "", formatFloat(plan.CashFlow), unit)
+	for _, d := range plan.Distributions {
+		record("target", d.InstrumentName, "", "", "", formatFloat(d.Distribution))
+	}
+	for _, d := range plan.Deviations {
+		record("deviation", d.InstrumentName, "", formatFloat(d.Amount), unit, "", "", "", formatFloat(d.Band))
+	}
+	for _, d := range plan.ClassDeviations {
+		record("class-deviation", d.Class, "", formatFloat(d.Amount), unit, "", "", "", "", strconv.Itoa(d.Level))
+	}
+	for _, t := range plan.Transfers {
+		record("transfer", t.From, t.To, formatFloat(t.Amount), unit, formatFloat(t.Volume), t.Account, t.Kind.String())
+		if plan.BaseCurrency != "" {
+			record("transfer-from", t.From, "", formatFloat(t.FromAmount), t.FromCurrency, "", t.Account)
+			record("transfer-to", t.To, "", formatFloat(t.ToAmount), t.ToCurrency, "", t.Account)
+		}
+	}
+	for _, name := range plan.Unmatched {
+		record("unmatched", name)
+	}
+	for _, p := range plan.DistributionProblems {
+		record("problem", "", "", "", "", "", "", "", "", "", p.Error())
+	}
+
+	return csv.NewWriter(w).WriteAll(records)
+}
+
+// planUnit returns the unit that the amounts of the plan are in, i.e. its
+// base currency or else the unit of its positions.
+func planUnit(plan *Plan) string {
+	if plan.BaseCurrency != "" || len(plan.Positions) == 0 {
+		return plan.BaseCurrency
+	}
+	return plan.Positions[0].Value.Unit
+}
+
+// WriteMarkdown writes the plan to w as a Markdown document with one table per
+// section.
+func WriteMarkdown(w io.Writer, plan *Plan) error {
+	var b strings.Builder
+
+	accounts := accountNames(plan)
+	fmt.Fprintf(&b, "## Current positions\n\n")
+	fmt.Fprintf(&b, "| Instrument | Value | Unit |\n|---|---:|---|\n")
+	for _, p := range plan.Positions {
+		fmt.Fprintf(&b, "| %s%s | %.2f | %s |\n", accountPrefix(accounts, p.Account.ID), escapeMarkdown(p.Instrument.Name), p.Value.Value, p.Value.Unit)
+	}
+	fmt.Fprintln(&b)
+
+	if plan.CashFlow != 0 {
+		fmt.Fprintf(&b, "Cash flow: %.2f\n\n", plan.CashFlow)
+	}
+
+	fmt.Fprintf(&b, "## Target distribution\n\n")
+	fmt.Fprintf(&b, "| Instrument | Distribution |\n|---|---:|\n")
+	for _, d := range plan.Distributions {
+		fmt.Fprintf(&b, "| %s | %.2f %% |\n", escapeMarkdown(d.InstrumentName), 100*d.Distribution)
+	}
+	fmt.Fprintf(&b, "| **Total** | **%.2f %%** |\n\n", 100*distributionSum(plan))
+
+	fmt.Fprintf(&b, "## Deviations\n\n")
+	fmt.Fprintf(&b, "| Instrument | Deviation | Band |\n|---|---:|---:|\n")
+	for _, d := range plan.Deviations {
+		fmt.Fprintf(&b, "| %s | %.2f | ± %.2f |\n", escapeMarkdown(d.InstrumentName), d.Amount, d.Band)
+	}
+	fmt.Fprintln(&b)
+
+	if len(plan.ClassDeviations) > 0 {
+		fmt.Fprintf(&b, "## Deviations per asset class\n\n")
+		fmt.Fprintf(&b, "| Asset class | Deviation |\n|---|---:|\n")
+		for _, d := range plan.ClassDeviations {
+			fmt.Fprintf(&b, "| %s | %.2f |\n", escapeMarkdown(d.Class), d.Amount)
+		}
+		fmt.Fprintln(&b)
+	}
+
+	fmt.Fprintf(&b, "## Transfers\n\n")
+	if plan.BaseCurrency != "" {
+		fmt.Fprintf(&b, "| Kind | From | To | Amount | Volume | From amount | To amount |\n|---|---|---|---:|---:|---:|---:|\n")
+	} else {
+		fmt.Fprintf(&b, "| Kind | From | To | Amount | Volume |\n|---|---|---|---:|---:|\n")
+	}
+	for _, t := range plan.Transfers {
+		from, to := transferEnds(t)
+		fmt.Fprintf(&b, "| %s | %s%s | %s | %.2f | %.2f %% |", t.Kind, accountPrefix(accounts, t.Account), escapeMarkdown(from), escapeMarkdown(to), t.Amount, 100*t.Volume)
+		if plan.BaseCurrency != "" {
+			fmt.Fprintf(&b, " %.2f %s | %.2f %s |", t.FromAmount, t.FromCurrency, t.ToAmount, t.ToCurrency)
+		}
+		fmt.Fprintln(&b)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func distributionSum(plan *Plan) float64 {
+	sum := 0.0
+	for _, d := range plan.Distributions {
+		sum += d.Distribution
+	}
+	return sum
+}
+
+func deviationSum(plan *Plan) float64 {
+	sum := 0.0
+	for _, d := range plan.Deviations {
+		sum += d.Amount
+	}
+	return sum
+}
+
+// accountNames returns the names of the accounts of the plan by their IDs if
+// it spans more than one, or nil otherwise.
+func accountNames(plan *Plan) map[string]string {
+	names := map[string]string{}
+	for _, p := range plan.Positions {
+		name := p.Account.Name
+		if name == "" {
+			name = p.Account.ID
+		}
+		names[p.Account.ID] = name
+	}
+	if len(names) < 2 {
+		return nil
+	}
+	return names
+}
+
+// accountPrefix returns the name of the account in brackets to prefix
+// instruments with, if there are several accounts.
+func accountPrefix(names map[string]string, account string) string {
+	if names == nil {
+		return ""
+	}
+	return "[" + names[account] + "] "
+}
+
+// transferEnds returns display names for what the transfer goes from and to.
+func transferEnds(t Transfer) (from, to string) {
+	from, to = t.From, t.To
+	if from == cashFlowInstrument {
+		from = "(deposit)"
+	}
+	if to == cashFlowInstrument {
+		to = "(withdrawal)"
+	}
+	return from, to
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func escapeMarkdown(s string) string {
+	return strings.ReplaceAll(s, "|", `\|`)
+}
@@ -0,0 +1,268 @@
+package transfers
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func testPlan() *Plan {
+	return &Plan{
+		Positions: []Position{
+			{
+				ID:         "A",
+				Instrument: Fund{BaseInstrument{Name: "A fund"}},
+				Value:      Value{Value: 100.00, Unit: "SEK"},
+			},
+			{
+				ID:         "B",
+				Instrument: Fund{BaseInstrument{Name: "B fund"}},
+				Value:      Value{Value: 300.00, Unit: "SEK"},
+			},
+		},
+		Distributions: []Distribution{
+			{InstrumentName: "A fund", Distribution: 0.5},
+			{InstrumentName: "B fund", Distribution: 0.5},
+		},
+		Deviations: []Deviation{
+			{InstrumentName: "A fund", Amount: -100},
+			{InstrumentName: "B fund", Amount: 100},
+		},
+		Transfers: []Transfer{
+			{From: "B fund", To: "A fund", Amount: 100, Volume: 0.25},
+		},
+	}
+}
+
+// testPlanFull returns a plan with every section, over several accounts and
+// converted from a base currency.
+func testPlanFull() *Plan {
+	return &Plan{
+		Positions: []Position{
+			{
+				ID:         "A",
+				Account:    Account{ID: "1", Name: "ISK"},
+				Instrument: Fund{BaseInstrument{Name: "A fund"}},
+				Value:      Value{Value: 100.00, Unit: "SEK"},
+			},
+			{
+				ID:         "B",
+				Account:    Account{ID: "2", Name: "KF"},
+				Instrument: Fund{BaseInstrument{Name: "B | fund"}},
+				Value:      Value{Value: 300.00, Unit: "SEK"},
+			},
+		},
+		CashFlow: 100,
+		Distributions: []Distribution{
+			{InstrumentName: "A fund", Distribution: 0.5},
+			{InstrumentName: "B | fund", Distribution: 0.5},
+		},
+		Deviations: []Deviation{
+			{InstrumentName: "A fund", Amount: -150, Band: 10},
+			{InstrumentName: "B | fund", Amount: 50, Band: 10},
+		},
+		ClassDeviations: []ClassDeviation{
+			{Class: "equities", Level: 0, Amount: -100},
+			{Class: "equities/global", Level: 1, Amount: -100},
+		},
+		Transfers: []Transfer{
+			{Kind: Buy, Account: "1", From: cashFlowInstrument, To: "A fund", Amount: 100, Volume: 1, FromAmount: 100, FromCurrency: "SEK", ToAmount: 10, ToCurrency: "USD"},
+		},
+		Unmatched:            []string{"C fund"},
+		BaseCurrency:         "SEK",
+		DistributionProblems: []error{errors.New("sum of distribution is 0.9")},
+	}
+}
+
+func TestWriteJSON(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteJSON(&b, testPlan()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{
+  "positions": [
+    {
+      "instrument": "A fund",
+      "value": 100,
+      "unit": "SEK"
+    },
+    {
+      "instrument": "B fund",
+      "value": 300,
+      "unit": "SEK"
+    }
+  ],
+  "cashFlow": 0,
+  "targets": [
+    {
+      "instrument": "A fund",
+      "distribution": 0.5
+    },
+    {
+      "instrument": "B fund",
+      "distribution": 0.5
+    }
+  ],
+  "deviations": [
+    {
+      "instrument": "A fund",
+      "amount": -100,
+      "band": 0
+    },
+    {
+      "instrument": "B fund",
+      "amount": 100,
+      "band": 0
+    }
+  ],
+  "transfers": [
+    {
+      "kind": "switch",
+      "from": "B fund",
+      "to": "A fund",
+      "amount": 100,
+      "volume": 0.25
+    }
+  ]
+}
+`
+	if got := b.String(); want != got {
+		t.Errorf("WriteJSON() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteCSV(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteCSV(&b, testPlan()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `section,instrument,to,amount,unit,share,account,kind,band,level,message
+position,A fund,,100,SEK,,,,,,
+position,B fund,,300,SEK,,,,,,
+cashflow,,,0,SEK,,,,,,
+target,A fund,,,,0.5,,,,,
+target,B fund,,,,0.5,,,,,
+deviation,A fund,,-100,SEK,,,,0,,
+deviation,B fund,,100,SEK,,,,0,,
+transfer,B fund,A fund,100,SEK,0.25,,switch,,,
+`
+	if got := b.String(); want != got {
+		t.Errorf("WriteCSV() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteCSV_AllSections(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteCSV(&b, testPlanFull()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `section,instrument,to,amount,unit,share,account,kind,band,level,message
+position,A fund,,100,SEK,,1,,,,
+position,B | fund,,300,SEK,,2,,,,
+cashflow,,,100,SEK,,,,,,
+target,A fund,,,,0.5,,,,,
+target,B | fund,,,,0.5,,,,,
+deviation,A fund,,-150,SEK,,,,10,,
+deviation,B | fund,,50,SEK,,,,10,,
+class-deviation,equities,,-100,SEK,,,,,0,
+class-deviation,equities/global,,-100,SEK,,,,,1,
+transfer,,A fund,100,SEK,1,1,buy,,,
+transfer-from,,,100,SEK,,1,,,,
+transfer-to,A fund,,10,USD,,1,,,,
+unmatched,C fund,,,,,,,,,
+problem,,,,,,,,,,sum of distribution is 0.9
+`
+	if got := b.String(); want != got {
+		t.Errorf("WriteCSV() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteMarkdown(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteMarkdown(&b, testPlanFull()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `## Current positions
+
+| Instrument | Value | Unit |
+|---|---:|---|
+| [ISK] A fund | 100.00 | SEK |
+| [KF] B \| fund | 300.00 | SEK |
+
+Cash flow: 100.00
+
+## Target distribution
+
+| Instrument | Distribution |
+|---|---:|
+| A fund | 50.00 % |
+| B \| fund | 50.00 % |
+| **Total** | **100.00 %** |
+
+## Deviations
+
+| Instrument | Deviation | Band |
+|---|---:|---:|
+| A fund | -150.00 | ± 10.00 |
+| B \| fund | 50.00 | ± 10.00 |
+
+## Deviations per asset class
+
+| Asset class | Deviation |
+|---|---:|
+| equities | -100.00 |
+| equities/global | -100.00 |
+
+## Transfers
+
+| Kind | From | To | Amount | Volume | From amount | To amount |
+|---|---|---|---:|---:|---:|---:|
+| buy | [ISK] (deposit) | A fund | 100.00 | 100.00 % | 100.00 SEK | 10.00 USD |
+`
+	if got := b.String(); want != got {
+		t.Errorf("WriteMarkdown() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteText(&b, testPlanFull()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# Current positions (# 2)
+[ISK] A fund                                       :     100.00 SEK
+[KF] B | fund                                     :     300.00 SEK
+
+# Cash flow: 100.00
+
+# Target distribution (100.000000 %)
+A fund                                       :  50.00 %
+B | fund                                     :  50.00 %
+
+# Calculated deviations (∑ -100.000000)
+A fund                                       :    -150.00   (± 10.00)
+B | fund                                     :      50.00   (± 10.00)
+
+# Calculated deviations per asset class
+equities                                     :    -100.00
+  global                                     :    -100.00
+
+# Calculated transfers (# 1)
+[ISK] (deposit)                                     -> A fund                                        :     100.00   (100.0000000000000000 %)   [100.00 SEK -> 10.00 USD]
+`
+	if got := b.String(); want != got {
+		t.Errorf("WriteText() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWrite_UnknownFormat(t *testing.T) {
+	var b bytes.Buffer
+	if err := Write(&b, testPlan(), Format("xml")); err == nil {
+		t.Error("Write() error = nil, want error")
+	}
+}
@@ -0,0 +1,365 @@
+package transfers
+
+import (
+	"math"
+)
+
+// Tolerances and limits used by the simplex method.
+const (
+	pivotTol    = 1e-9
+	costTol     = 1e-9
+	primalTol   = 1e-6
+	refactorGap = 50
+	// Number of columns to price before choosing among the candidates
+	// found, if any
+	pricingChunk = 1000
+)
+
+// simplexSolver solves linear programs with a pure Go simplex method.
+type simplexSolver struct{}
+
+func (simplexSolver) solve(p *problem) ([]float64, float64, lpStatus) {
+	s := newSimplex(p)
+	status := s.solve(p.obj)
+
+	soln := append([]float64(nil), s.x[:len(p.obj)]...)
+	value := 0.0
+	for j, c := range p.obj {
+		value += c * soln[j]
+	}
+	return soln, value, status
+}
+
+// simplex solves a linear program with a bounded primal revised simplex
+// method. The program is brought on the form
+//
+//	A·x - s + D·a = 0
+//
+// where each row slack s inherits the bounds of its row and each artificial a
+// (D being a diagonal ±1 matrix) is only used to find a first feasible basis.
+type simplex struct {
+	m, n    int // number of rows and of columns in total
+	nStruct int // number of structural columns
+
+	cols   [][]nonzero
+	cost   []float64
+	lo, up []float64
+	x      []float64
+
+	basis []int       // basis[i] is the column that is basic in row i
+	pos   []int       // pos[j] is the row in which j is basic, or -1
+	binv  [][]float64 // inverse of the basis matrix
+
+	iters, maxIters int
+	next            int // column to continue pricing from
+}
+
+func newSimplex(p *problem) *simplex {
+	m, nStruct := len(p.rowBounds), len(p.obj)
+	s := &simplex{
+		m:       m,
+		n:       nStruct + 2*m,
+		nStruct: nStruct,
+	}
+	s.cols = make([][]nonzero, s.n)
+	s.cost = make([]float64, s.n)
+	s.lo = make([]float64, s.n)
+	s.up = make([]float64, s.n)
+	s.x = make([]float64, s.n)
+	s.basis = make([]int, m)
+	s.pos = make([]int, s.n)
+	s.binv = make([][]float64, m)
+	s.maxIters = 100 * (s.n + m)
+	for j := range s.pos {
+		s.pos[j] = -1
+	}
+
+	for j := 0; j < nStruct; j++ {
+		s.cols[j] = p.cols[j]
+		s.lo[j], s.up[j] = p.colBounds[j][0], p.colBounds[j][1]
+		s.x[j] = nonbasicValue(s.lo[j], s.up[j])
+	}
+
+	activity := make([]float64, m)
+	for j := 0; j < nStruct; j++ {
+		for _, nz := range s.cols[j] {
+			activity[nz.row] += nz.val * s.x[j]
+		}
+	}
+
+	for i := 0; i < m; i++ {
+		slack, art := nStruct+i, nStruct+m+i
+		s.cols[slack] = []nonzero{{row: i, val: -1}}
+		lb, ub := p.rowBounds[i][0], p.rowBounds[i][1]
+		s.lo[slack], s.up[slack] = lb, ub
+		s.binv[i] = make([]float64, m)
+
+		v := math.Max(lb, math.Min(ub, activity[i]))
+		s.x[slack] = v
+		if v == activity[i] {
+			s.cols[art] = []nonzero{{row: i, val: 1}}
+			s.setBasic(i, slack)
+			s.binv[i][i] = -1
+			continue
+		}
+
+		sign := 1.0
+		if v < activity[i] {
+			sign = -1
+		}
+		s.cols[art] = []nonzero{{row: i, val: sign}}
+		s.lo[art], s.up[art] = 0, math.Inf(1)
+		s.x[art] = math.Abs(v - activity[i])
+		s.cost[art] = 1
+		s.setBasic(i, art)
+		s.binv[i][i] = sign
+	}
+	return s
+}
+
+// nonbasicValue returns the value a nonbasic column starts out with.
+func nonbasicValue(lo, up float64) float64 {
+	switch {
+	case !math.IsInf(lo, -1):
+		return lo
+	case !math.IsInf(up, 1):
+		return up
+	default:
+		return 0
+	}
+}
+
+func (s *simplex) setBasic(row, col int) {
+	s.basis[row] = col
+	s.pos[col] = row
+}
+
+// solve runs both phases of the simplex method and returns the status of the
+// final solution.
+func (s *simplex) solve(obj []float64) lpStatus {
+	if status := s.iterate(); status != lpOptimal {
+		return status
+	}
+	for i := 0; i < s.m; i++ {
+		if art := s.nStruct + s.m + i; s.x[art] > primalTol {
+			return lpInfeasible
+		}
+	}
+
+	for j := range s.cost {
+		s.cost[j] = 0
+	}
+	copy(s.cost, obj)
+	for i := 0; i < s.m; i++ {
+		art := s.nStruct + s.m + i
+		s.lo[art], s.up[art] = 0, 0
+		s.x[art] = 0
+	}
+
+	return s.iterate()
+}
+
+func (s *simplex) iterate() lpStatus {
+	y := make([]float64, s.m)
+	alpha := make([]float64, s.m)
+	degenerate, bland := 0, false
+
+	for ; ; s.iters++ {
+		if s.iters >= s.maxIters {
+			return lpIterationLimit
+		}
+		if s.iters > 0 && s.iters%refactorGap == 0 {
+			if !s.refactor() {
+				return lpIterationLimit
+			}
+		}
+
+		for k := range y {
+			y[k] = 0
+		}
+		for i, j := range s.basis {
+			if c := s.cost[j]; c != 0 {
+				for k, v := range s.binv[i] {
+					y[k] += c * v
+				}
+			}
+		}
+
+		// Price the columns in chunks, continuing where the last iteration
+		// left off, unless falling back on Bland's rule of choosing the
+		// first candidate.
+		enter, dir, best := -1, 0.0, 0.0
+		start := s.next
+		if bland {
+			start = 0
+		}
+		for scanned := 0; scanned < s.n; scanned++ {
+			j := (start + scanned) % s.n
+			if enter >= 0 && scanned >= pricingChunk {
+				s.next = j
+				break
+			}
+			if s.pos[j] >= 0 || s.up[j]-s.lo[j] <= pivotTol {
+				continue
+			}
+			d := s.cost[j]
+			for _, nz := range s.cols[j] {
+				d -= y[nz.row] * nz.val
+			}
+			var jdir float64
+			switch {
+			case d < -costTol && s.x[j] < s.up[j]-pivotTol:
+				jdir = 1
+			case d > costTol && s.x[j] > s.lo[j]+pivotTol:
+				jdir = -1
+			default:
+				continue
+			}
+			if bland {
+				enter, dir = j, jdir
+				break
+			}
+			if math.Abs(d) > best {
+				enter, dir, best = j, jdir, math.Abs(d)
+			}
+		}
+		if enter < 0 {
+			return lpOptimal
+		}
+
+		for i := range alpha {
+			alpha[i] = 0
+		}
+		for _, nz := range s.cols[enter] {
+			for i := range alpha {
+				alpha[i] += s.binv[i][nz.row] * nz.val
+			}
+		}
+
+		step, leave := s.up[enter]-s.lo[enter], -1
+		for i, j := range s.basis {
+			delta := -dir * alpha[i]
+			var limit float64
+			switch {
+			case delta < -pivotTol && !math.IsInf(s.lo[j], -1):
+				limit = (s.x[j] - s.lo[j]) / -delta
+			case delta > pivotTol && !math.IsInf(s.up[j], 1):
+				limit = (s.up[j] - s.x[j]) / delta
+			default:
+				continue
+			}
+			if limit < 0 {
+				limit = 0
+			}
+			if limit < step || (limit == step && leave >= 0 && math.Abs(alpha[i]) > math.Abs(alpha[leave])) {
+				step, leave = limit, i
+			}
+		}
+		if math.IsInf(step, 1) {
+			return lpUnbounded
+		}
+
+		if step <= pivotTol {
+			if degenerate++; degenerate > 2*s.m {
+				bland = true
+			}
+		} else {
+			degenerate, bland = 0, false
+		}
+
+		s.x[enter] += dir * step
+		for i, j := range s.basis {
+			s.x[j] -= dir * alpha[i] * step
+		}
+
+		if leave < 0 {
+			if dir > 0 {
+				s.x[enter] = s.up[enter]
+			} else {
+				s.x[enter] = s.lo[enter]
+			}
+			continue
+		}
+
+		out := s.basis[leave]
+		if -dir*alpha[leave] < 0 {
+			s.x[out] = s.lo[out]
+		} else {
+			s.x[out] = s.up[out]
+		}
+
+		pivot := s.binv[leave]
+		p := alpha[leave]
+		for k := range pivot {
+			pivot[k] /= p
+		}
+		for i, row := range s.binv {
+			if f := alpha[i]; i != leave && f != 0 {
+				for k, v := range pivot {
+					row[k] -= f * v
+				}
+			}
+		}
+		s.pos[out] = -1
+		s.setBasic(leave, enter)
+	}
+}
+
+// refactor recomputes the basis inverse and the values of the basic columns
+// from scratch to get rid of accumulated rounding errors.
+func (s *simplex) refactor() bool {
+	aug := make([][]float64, s.m)
+	for i := range aug {
+		aug[i] = make([]float64, 2*s.m)
+		aug[i][s.m+i] = 1
+	}
+	for i, j := range s.basis {
+		for _, nz := range s.cols[j] {
+			aug[nz.row][i] = nz.val
+		}
+	}
+
+	for c := 0; c < s.m; c++ {
+		p := c
+		for r := c + 1; r < s.m; r++ {
+			if math.Abs(aug[r][c]) > math.Abs(aug[p][c]) {
+				p = r
+			}
+		}
+		if math.Abs(aug[p][c]) < pivotTol {
+			return false
+		}
+		aug[c], aug[p] = aug[p], aug[c]
+		pv := aug[c][c]
+		for k := range aug[c] {
+			aug[c][k] /= pv
+		}
+		for r := range aug {
+			if f := aug[r][c]; r != c && f != 0 {
+				for k := range aug[r] {
+					aug[r][k] -= f * aug[c][k]
+				}
+			}
+		}
+	}
+	for i := range s.binv {
+		copy(s.binv[i], aug[i][s.m:])
+	}
+
+	rhs := make([]float64, s.m)
+	for j := 0; j < s.n; j++ {
+		if s.pos[j] < 0 && s.x[j] != 0 {
+			for _, nz := range s.cols[j] {
+				rhs[nz.row] -= nz.val * s.x[j]
+			}
+		}
+	}
+	for i, j := range s.basis {
+		v := 0.0
+		for k, b := range s.binv[i] {
+			v += b * rhs[k]
+		}
+		s.x[j] = v
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+package transfers
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSimplexSolver(t *testing.T) {
+	inf := math.Inf(1)
+	tests := []struct {
+		name    string
+		problem func() *problem
+		status  lpStatus
+		soln    []float64
+	}{
+		{
+			name: "optimal",
+			// minimize x + 2y such that x + y = 4 and x ≤ 3
+			problem: func() *problem {
+				p := &problem{}
+				row := p.addRow(4, 4)
+				p.addCol(1, 0, 3, nonzero{row: row, val: 1})
+				p.addCol(2, 0, inf, nonzero{row: row, val: 1})
+				return p
+			},
+			status: lpOptimal,
+			soln:   []float64{3, 1},
+		},
+		{
+			name: "bounded by rows",
+			// minimize -x such that x - y ≤ 1 and y ≤ 2
+			problem: func() *problem {
+				p := &problem{}
+				row := p.addRow(-inf, 1)
+				p.addCol(-1, 0, inf, nonzero{row: row, val: 1})
+				p.addCol(0, 0, 2, nonzero{row: row, val: -1})
+				return p
+			},
+			status: lpOptimal,
+			soln:   []float64{3, 2},
+		},
+		{
+			name: "infeasible",
+			// x ≥ 2 and x ≤ 1
+			problem: func() *problem {
+				p := &problem{}
+				row := p.addRow(2, inf)
+				p.addCol(1, 0, 1, nonzero{row: row, val: 1})
+				return p
+			},
+			status: lpInfeasible,
+		},
+		{
+			name: "unbounded",
+			// minimize -x such that x - y ≤ 1
+			problem: func() *problem {
+				p := &problem{}
+				row := p.addRow(-inf, 1)
+				p.addCol(-1, 0, inf, nonzero{row: row, val: 1})
+				p.addCol(0, 0, inf, nonzero{row: row, val: -1})
+				return p
+			},
+			status: lpUnbounded,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			soln, _, status := simplexSolver{}.solve(tt.problem())
+			if want, got := tt.status, status; want != got {
+				t.Fatalf("status = %v, want %v", got, want)
+			}
+			for i, want := range tt.soln {
+				if got := soln[i]; math.Abs(want-got) > 1e-9 {
+					t.Errorf("soln[%d] = %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
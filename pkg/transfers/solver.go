@@ -0,0 +1,213 @@
+package transfers
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// lpStatus is the outcome of solving a linear program.
+type lpStatus int
+
+// Outcomes of solving a linear program.
+const (
+	lpOptimal lpStatus = iota
+	lpInfeasible
+	lpUnbounded
+	lpIterationLimit
+)
+
+// err returns the error of the outcome, or nil if it is optimal.
+func (s lpStatus) err() error {
+	switch s {
+	case lpOptimal:
+		return nil
+	case lpInfeasible:
+		return ErrInfeasible
+	case lpUnbounded:
+		return ErrUnbounded
+	case lpIterationLimit:
+		return ErrIterationLimit
+	}
+	return fmt.Errorf("unknown solver status %d", s)
+}
+
+// Errors that may occur when solving for the transfers.
+var (
+	ErrInfeasible     = errors.New("no feasible transfers")
+	ErrUnbounded      = errors.New("unbounded transfers")
+	ErrIterationLimit = errors.New("iteration limit reached")
+)
+
+// SolverError is returned when the transfers cannot be solved for. It wraps
+// the cause, e.g. ErrInfeasible or a *ResidualError, and holds the linear
+// program solved in CPLEX LP format for diagnostics.
+type SolverError struct {
+	Err   error
+	Model string
+}
+
+func (e *SolverError) Error() string {
+	return "solving for transfers: " + e.Err.Error()
+}
+
+func (e *SolverError) Unwrap() error {
+	return e.Err
+}
+
+// ResidualError is returned when the transfers solved for do not take an
+// instrument within the bounds of its net amount transferred out, e.g. due to
+// numerical errors.
+type ResidualError struct {
+	Instrument string
+	// Bounds on the net amount to transfer out of the instrument
+	Want [2]float64
+	// Net amount transferred out of the instrument
+	Got float64
+}
+
+func (e *ResidualError) Error() string {
+	return fmt.Sprintf("net amount transferred out of %q is %g, want %g to %g", e.Instrument, e.Got, e.Want[0], e.Want[1])
+}
+
+// solver solves linear programs.
+type solver interface {
+	// solve returns the solution found, its objective value and whether it
+	// is optimal.
+	solve(p *problem) ([]float64, float64, lpStatus)
+}
+
+// problem is a linear program on sparse, column-wise form: minimize obj·x
+// such that each column x[j] is within colBounds[j] and the activity of each
+// row, i.e. the sum of its coefficients times their columns, is within
+// rowBounds[i].
+type problem struct {
+	obj       []float64
+	cols      [][]nonzero
+	colBounds [][2]float64
+	rowBounds [][2]float64
+}
+
+// nonzero is a nonzero coefficient of a column.
+type nonzero struct {
+	row int
+	val float64
+}
+
+// addRow adds a row with the given bounds and returns its index.
+func (p *problem) addRow(lb, ub float64) int {
+	p.rowBounds = append(p.rowBounds, [2]float64{lb, ub})
+	return len(p.rowBounds) - 1
+}
+
+// addCol adds a column with the given objective coefficient, bounds and
+// coefficients, and returns its index.
+func (p *problem) addCol(cost, lb, ub float64, coefs ...nonzero) int {
+	p.obj = append(p.obj, cost)
+	p.cols = append(p.cols, coefs)
+	p.colBounds = append(p.colBounds, [2]float64{lb, ub})
+	return len(p.obj) - 1
+}
+
+// addCoef adds a coefficient for a column on a row that has none.
+func (p *problem) addCoef(row, col int, val float64) {
+	p.cols[col] = append(p.cols[col], nonzero{row: row, val: val})
+}
+
+// activities returns the activity of each row for the given solution.
+func (p *problem) activities(x []float64) []float64 {
+	activities := make([]float64, len(p.rowBounds))
+	for j, col := range p.cols {
+		for _, nz := range col {
+			activities[nz.row] += nz.val * x[j]
+		}
+	}
+	return activities
+}
+
+// format returns the problem in CPLEX LP format with the given names of its
+// columns and rows. Ranged rows are split in two.
+func (p *problem) format(integer []bool, colName, rowName func(int) string) string {
+	var sb strings.Builder
+	writeTerms := func(coefs []nonzero, name func(int) string) {
+		for _, nz := range coefs {
+			sign := "+"
+			if nz.val < 0 {
+				sign = "-"
+			}
+			fmt.Fprintf(&sb, " %s %g %s", sign, math.Abs(nz.val), name(nz.row))
+		}
+	}
+
+	sb.WriteString("Minimize\n obj:")
+	var obj []nonzero
+	for j, c := range p.obj {
+		if c != 0 {
+			obj = append(obj, nonzero{row: j, val: c})
+		}
+	}
+	writeTerms(obj, colName)
+
+	rows := make([][]nonzero, len(p.rowBounds))
+	for j, col := range p.cols {
+		for _, nz := range col {
+			rows[nz.row] = append(rows[nz.row], nonzero{row: j, val: nz.val})
+		}
+	}
+	sb.WriteString("\nSubject To\n")
+	for i, bounds := range p.rowBounds {
+		lb, ub := bounds[0], bounds[1]
+		switch {
+		case len(rows[i]) == 0:
+			fmt.Fprintf(&sb, "\\ %s: empty within %g to %g\n", rowName(i), lb, ub)
+			continue
+		case lb == ub:
+			fmt.Fprintf(&sb, " %s:", rowName(i))
+			writeTerms(rows[i], colName)
+			fmt.Fprintf(&sb, " = %g\n", lb)
+			continue
+		case math.IsInf(lb, -1) && math.IsInf(ub, 1):
+			continue
+		}
+		if !math.IsInf(lb, -1) {
+			fmt.Fprintf(&sb, " %s_lo:", rowName(i))
+			writeTerms(rows[i], colName)
+			fmt.Fprintf(&sb, " >= %g\n", lb)
+		}
+		if !math.IsInf(ub, 1) {
+			fmt.Fprintf(&sb, " %s_hi:", rowName(i))
+			writeTerms(rows[i], colName)
+			fmt.Fprintf(&sb, " <= %g\n", ub)
+		}
+	}
+
+	sb.WriteString("Bounds\n")
+	for j, bounds := range p.colBounds {
+		lb, ub := bounds[0], bounds[1]
+		switch {
+		case lb == ub:
+			fmt.Fprintf(&sb, " %s = %g\n", colName(j), lb)
+		case math.IsInf(lb, -1) && math.IsInf(ub, 1):
+			fmt.Fprintf(&sb, " %s free\n", colName(j))
+		case math.IsInf(ub, 1):
+			fmt.Fprintf(&sb, " %s >= %g\n", colName(j), lb)
+		case math.IsInf(lb, -1):
+			fmt.Fprintf(&sb, " -inf <= %s <= %g\n", colName(j), ub)
+		default:
+			fmt.Fprintf(&sb, " %g <= %s <= %g\n", lb, colName(j), ub)
+		}
+	}
+
+	var general []string
+	for j, isInteger := range integer {
+		if isInteger {
+			general = append(general, colName(j))
+		}
+	}
+	if len(general) > 0 {
+		sb.WriteString("General\n " + strings.Join(general, " ") + "\n")
+	}
+	sb.WriteString("End\n")
+	return sb.String()
+}
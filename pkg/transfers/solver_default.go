@@ -0,0 +1,7 @@
+//go:build !clp
+// +build !clp
+
+package transfers
+
+// defaultSolver is the pure Go simplex solver, unless built with the clp tag.
+var defaultSolver solver = simplexSolver{}
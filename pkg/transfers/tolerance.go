@@ -0,0 +1,57 @@
+package transfers
+
+import (
+	"math"
+)
+
+// Tolerance describes a band around the target value of an instrument within
+// which deviations are left alone. Limits that are zero are not in effect. An
+// instrument is outside its band as soon as it breaches either of the others.
+type Tolerance struct {
+	// Allowed deviation in percentage points of the total value, e.g. 0.02
+	Absolute float64
+	// Allowed deviation relative to the target value, e.g. 0.05
+	Relative float64
+}
+
+// width returns the deviation in value allowed in either direction from the
+// given target value.
+func (t Tolerance) width(target, total float64) float64 {
+	width := math.Inf(1)
+	if t.Absolute > 0 {
+		width = t.Absolute * total
+	}
+	if t.Relative > 0 {
+		width = math.Min(width, t.Relative*target)
+	}
+	if math.IsInf(width, 1) {
+		return 0
+	}
+	return width
+}
+
+// RebalanceMode is how far instruments outside their tolerance bands are
+// rebalanced.
+type RebalanceMode int
+
+// Supported rebalance modes.
+const (
+	// RebalanceToTarget rebalances instruments outside their bands all the
+	// way to their target values.
+	RebalanceToTarget RebalanceMode = iota
+	// RebalanceToEdge rebalances instruments outside their bands only to the
+	// closest edge of their bands.
+	RebalanceToEdge
+)
+
+// outflowBounds returns the lower and upper bounds on the net amount to
+// transfer out of an instrument with the given current and target values
+// such that it ends up within a band of the given width around its target.
+// An instrument outside its band is rebalanced according to mode.
+func outflowBounds(current, target, width float64, mode RebalanceMode) [2]float64 {
+	dev := current - target
+	if mode == RebalanceToTarget && math.Abs(dev) > width {
+		return [2]float64{dev, dev}
+	}
+	return [2]float64{dev - width, dev + math.Min(width, target)}
+}
@@ -3,112 +3,478 @@ package transfers
 import (
 	"errors"
 	"fmt"
-	"log"
 	"math"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Plan describes how to rebalance a set of positions towards a target
+// distribution.
+type Plan struct {
+	// Positions are the current positions.
+	Positions []Position
+	// Distributions is the target distribution.
+	Distributions []Distribution
+	// Deviations holds the deviation from the target value per instrument.
+	Deviations []Deviation
+	// ClassDeviations holds the deviation from the target value per asset
+	// class in pre-order, if targets are set per asset class, see
+	// WithAssetClasses.
+	ClassDeviations []ClassDeviation
+	// Transfers are the transfers that rebalance the positions.
+	Transfers []Transfer
+	// CashFlow is the amount deposited (positive) or withdrawn (negative).
+	CashFlow float64
+	// Unmatched lists the instruments that are only found among either the
+	// positions or the target distribution.
+	Unmatched []string
+	// BaseCurrency is the currency that amounts are in, if the positions
+	// have been converted into it, see WithBaseCurrency.
+	BaseCurrency string
+	// DistributionProblems lists the problems found with the target
+	// distribution, which have been normalized away if so requested.
+	DistributionProblems []error
+}
+
+// Deviation is the amount by which the current value of an instrument exceeds
+// its target value. A negative amount means that the instrument is below its
+// target value.
+type Deviation struct {
+	InstrumentName string
+	Amount         float64
+	// Band is the deviation allowed in either direction before the
+	// instrument is rebalanced, see Tolerance.
+	Band float64
+}
+
+// Transfer is an amount to move from one instrument to another. Money
+// deposited has no From instrument and money withdrawn has no To instrument.
+type Transfer struct {
+	Kind TransferKind
+	// Account is the ID of the account that the transfer is made within.
+	Account string
+	From    string
+	To      string
+	Amount  float64
+	// Decimal percentage of the value of the From position, or of the
+	// deposit, e.g. 0.15
+	Volume float64
+
+	// Amount in the currencies of the From and To instruments, if converted
+	// from a base currency, see WithBaseCurrency
+	FromAmount   float64
+	FromCurrency string
+	ToAmount     float64
+	ToCurrency   string
+}
+
+// TransferKind tells what a transfer is carried out as.
+type TransferKind int
+
+// Kinds of transfers.
+const (
+	// Switch sells one instrument to buy another.
+	Switch TransferKind = iota
+	// Buy buys an instrument with cash or deposited money.
+	Buy
+	// Sell sells an instrument into cash or to withdraw money.
+	Sell
+)
+
+func (k TransferKind) String() string {
+	switch k {
+	case Buy:
+		return "buy"
+	case Sell:
+		return "sell"
+	default:
+		return "switch"
+	}
+}
+
+// cashFlowInstrument is the name of the pseudo instrument that represents
+// money deposited or withdrawn.
+const cashFlowInstrument = ""
 
-	"github.com/lanl/clp"
+// Errors that may occur when calculating a plan.
+var (
+	ErrNoPositions       = errors.New("no positions to rebalance")
+	ErrNoDistribution    = errors.New("empty target distribution")
+	ErrWithdrawal        = errors.New("withdrawal exceeds the total value")
+	ErrCashFlow          = errors.New("negative deposit or withdrawal")
+	ErrTransferCost      = errors.New("negative transfer cost")
+	ErrLocationCost      = errors.New("negative location cost")
+	ErrUnknownInstrument = errors.New("unknown instrument")
 )
 
-// Calculate finds a smallest set of amounts to transfer that balances the given
-// deviations and outputs the result to stdout.
-func Calculate(positions []Position, distributions []Distribution) {
+// Calculate finds a smallest set of amounts to transfer that balances the
+// deviations of the given positions from the target distribution. Positions
+// and distributions are matched by instrument ID, ISIN or name, in that
+// order; instruments without a match are listed in Plan.Unmatched.
+// Instruments of the same name but different IDs, or else ISINs, are told
+// apart by their IDs or ISINs in their names, e.g. "Global (878733)". Problems
+// with the targets are handled as set by WithDistributionMode, and targets
+// may be set per asset class, see WithAssetClasses. Positions in
+// several accounts are rebalanced together towards the targets, transferring
+// money only within each account, see Transfer.Account. What is considered
+// smallest is determined by the objective, see WithObjective.
+// Instruments that deviate less than their tolerance bands are only used as
+// counterparts to instruments outside their bands, see WithTolerance.
+//
+// Money may be deposited or withdrawn at the same time, see WithDeposit and
+// WithWithdrawal. The transfers are then limited to buys or sells that get
+// as close to the targets as possible, unless switches are allowed, see
+// WithSwitches. Likewise, constrained instruments get as close to their
+// targets as their constraints allow, see WithConstraints, and as transfers
+// of a minimum or rounded amount allow, see WithMinTransfer and WithRounding.
+// Instruments are moved between accounts towards where they are cheapest to
+// hold, if their location costs are set, see WithLocationCost.
+// A *ValidationReport is returned if the positions are inconsistent, see
+// ValidatePositions. A *ConstraintError is returned if the constraints cannot
+// all be satisfied, even if the transfers could be found without them, and a
+// *SolverError if the transfers cannot be solved for otherwise.
+func Calculate(positions []Position, distributions []Distribution, opts ...Option) (*Plan, error) {
+	o := newOptions(opts)
+
 	switch {
 	case len(positions) == 0:
-		log.Fatal("No positions to rebalance")
+		return nil, ErrNoPositions
 	case len(distributions) == 0:
-		log.Fatal("Empty target distribution")
+		return nil, ErrNoDistribution
+	case o.cashFlowErr != nil:
+		return nil, o.cashFlowErr
 	}
+	positions = distinctInstruments(positions)
 
-	balances, err := calculateBalances(positions, distributions)
-	if err != nil {
-		log.Fatal(err)
+	// Positions in other currencies are converted into the base currency,
+	// in which they may differ from each other in currency but not in unit.
+	var instrRates map[string]float64
+	if o.baseCurrency != "" {
+		var err error
+		positions, instrRates, err = convertPositions(positions, o.baseCurrency, o.rates)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if report := ValidatePositions(positions); report != nil {
+		if o.baseCurrency != "" {
+			report = report.without(ErrCurrency)
+		}
+		if report != nil {
+			return nil, report
+		}
 	}
-	balancer := newBalancer(balances)
-	transfers := balancer.optimalTransfers()
 
-	fmt.Printf("# Current positions (# %d)\n", len(positions))
-	for _, p := range positions {
-		fmt.Printf("%-45s: %10.2f %s\n", p.Instrument.Name, p.Value.Value, p.Value.Unit)
+	total, positionValue := 0.0, map[string]float64{}
+	isCash := map[string]bool{cashFlowInstrument: true}
+	instrCurrency := map[string]string{}
+	var accounts []string
+	held, accountTypes := map[string]map[string]float64{}, map[string]string{}
+	for _, pos := range positions {
+		total += pos.Value.Value
+		positionValue[pos.Instrument.Name] += pos.Value.Value
+		if held[pos.Account.ID] == nil {
+			accounts = append(accounts, pos.Account.ID)
+			held[pos.Account.ID] = map[string]float64{}
+		}
+		held[pos.Account.ID][pos.Instrument.Name] += pos.Value.Value
+		accountTypes[pos.Account.ID] = pos.Account.Type
+		isCash[pos.Instrument.Name] = pos.IsCash()
+		instrCurrency[pos.Instrument.Name] = pos.Instrument.Currency
+		if instrCurrency[pos.Instrument.Name] == "" {
+			instrCurrency[pos.Instrument.Name] = o.baseCurrency
+		}
 	}
-	fmt.Println()
 
-	dSum := 0.0
-	for _, d := range distributions {
-		dSum += 100 * d.Distribution
+	distributions, unmatched := matchDistributions(positions, distributions)
+	if o.assetClasses != nil {
+		var err error
+		if distributions, err = classTargets(o.assetClasses, distributions); err != nil {
+			return nil, err
+		}
 	}
-	fmt.Printf("# Target distribution (%f %%)\n", dSum)
-	for _, d := range distributions {
-		fmt.Printf("%-45s: %6.2f %%\n", d.InstrumentName, 100*d.Distribution)
+
+	problems := ValidateDistributions(distributions)
+	switch {
+	case len(problems) == 0:
+	case o.distMode == DistributionStrict:
+		return nil, &DistributionError{Problems: problems}
+	case o.distMode == DistributionNormalize:
+		normalized, err := normalizeDistributions(distributions)
+		if err != nil {
+			return nil, err
+		}
+		distributions = normalized
+	default:
+		distributions = mergeDistributions(distributions)
 	}
-	fmt.Println()
 
-	bSum := 0.0
-	for _, balance := range balances {
-		bSum += balance
+	if o.cashTarget != 0 {
+		scaled := make([]Distribution, 0, len(distributions)+1)
+		for _, dist := range distributions {
+			dist.Distribution *= 1 - o.cashTarget
+			scaled = append(scaled, dist)
+		}
+		distributions = append(scaled, Distribution{
+			InstrumentName: CashName,
+			Distribution:   o.cashTarget,
+		})
+		isCash[CashName] = true
 	}
-	fmt.Printf("# Calculated deviations (∑ %f)\n", bSum)
-	for instr, balance := range balances {
-		fmt.Printf("%-45s: %10.2f\n", instr, balance)
+
+	// The cash flow is a position without target value that is to be
+	// invested into, or made up from, the other positions.
+	allPositions := positions
+	if o.cashFlow != 0 {
+		if total+o.cashFlow < 0 {
+			return nil, ErrWithdrawal
+		}
+		cashFlow := positions[0]
+		cashFlow.ID = ""
+		cashFlow.Instrument = Fund{BaseInstrument{
+			Name:     cashFlowInstrument,
+			Currency: cashFlow.Instrument.Currency,
+		}}
+		cashFlow.Value.Value = o.cashFlow
+		allPositions = append(allPositions[:len(positions):len(positions)], cashFlow)
+		total += o.cashFlow
+		positionValue[cashFlowInstrument] = o.cashFlow
+	}
+	// Constraints given as options override those of the targets.
+	instrConstraints := map[string]Constraint{}
+	for _, dist := range distributions {
+		if dist.Constraint != nil {
+			instrConstraints[dist.InstrumentName] = *dist.Constraint
+		}
+	}
+	for instr, c := range o.constraints {
+		instrConstraints[instr] = c
 	}
-	fmt.Println()
 
-	positionValue := map[string]Value{}
-	for _, pos := range positions {
-		positionValue[pos.Instrument.Name] = pos.Value
+	cashFlowOnly := o.cashFlow != 0 && !o.allowSwitches
+	// Limited to the cash flow, by constraints or by the amounts that may be
+	// transferred, or with targets as given that may not sum to 1, the
+	// targets may not be reachable, so get as close to them as possible
+	// instead.
+	closest := cashFlowOnly || len(instrConstraints) > 0 || o.minTransfer > 0 || o.rounding ||
+		len(problems) > 0 && o.distMode == DistributionAsIs
+
+	balances, err := calculateBalances(allPositions, distributions)
+	if err != nil {
+		return nil, err
+	}
+	constrained := make([]string, 0, len(instrConstraints))
+	for instr := range instrConstraints {
+		constrained = append(constrained, instr)
+	}
+	sort.Strings(constrained)
+	for _, instr := range constrained {
+		if _, ok := balances[instr]; !ok {
+			return nil, fmt.Errorf("%w in constraints: %q", ErrUnknownInstrument, instr)
+		}
+	}
+	tolerances, instrClass := map[string]Tolerance{}, map[string]string{}
+	for _, dist := range distributions {
+		if dist.Tolerance != nil {
+			tolerances[dist.InstrumentName] = *dist.Tolerance
+		}
+		if o.assetClasses != nil && dist.AssetClass != "" {
+			instrClass[dist.InstrumentName] = dist.AssetClass
+		}
 	}
 
-	fmt.Printf("# Calculated transfers (# %d)\n", len(transfers))
-	for _, t := range transfers {
-		volume := t.amount / positionValue[t.from].Value * 100
-		fmt.Printf("%-45s -> %-45s : %10.2f   (%20.16f %%)\n", t.from, t.to, t.amount, volume)
+	bands, bounds, reach := map[string]float64{}, map[string][2]float64{}, map[string][2]float64{}
+	constraints, unconstrained := map[string]Constraint{}, map[string][2]float64{}
+	for instr, dev := range balances {
+		if instr == cashFlowInstrument {
+			bounds[instr] = [2]float64{dev, dev}
+			continue
+		}
+		tolerance, ok := tolerances[instr]
+		if !ok {
+			tolerance = o.tolerance
+		}
+		current := positionValue[instr]
+		target := current - dev
+		bands[instr] = tolerance.width(target, total)
+		switch {
+		case instrClass[instr] != "":
+			// The instruments of an asset class are rebalanced as far as
+			// the class is, see classRebalancing, and then only towards
+			// their own targets, so that the instruments furthest below
+			// them are bought and those furthest above them are sold.
+			bounds[instr] = [2]float64{math.Min(dev, 0), math.Max(dev, 0)}
+		case !closest:
+			bounds[instr] = outflowBounds(current, target, bands[instr], o.rebalanceMode)
+			continue
+		default:
+			// Let the instrument take part as far as it may, so that the
+			// transfers only get as close to the targets as possible
+			// rather than being bounded by them, and let it count as
+			// reaching its target within the band or at its edge
+			// depending on the mode.
+			edge := outflowBounds(current, target, bands[instr], RebalanceToEdge)
+			lb, ub := current-total, current
+			switch {
+			case !cashFlowOnly || isCash[instr]:
+			case o.cashFlow > 0:
+				ub = 0
+			default:
+				lb = 0
+			}
+			bounds[instr] = [2]float64{lb, ub}
+			if o.rebalanceMode == RebalanceToEdge {
+				reach[instr] = edge
+			} else {
+				reach[instr] = [2]float64{dev, dev}
+			}
+		}
+
+		if c, ok := instrConstraints[instr]; ok {
+			limits := c.outflowLimits(current, total)
+			if limits[0] > limits[1] {
+				return nil, &ConstraintError{Constraints: map[string]Constraint{instr: c}}
+			}
+			constraints[instr], unconstrained[instr] = c, bounds[instr]
+			bounds[instr] = clamp(bounds[instr], limits)
+		}
+		if r, ok := reach[instr]; ok {
+			// Only the distance that the instrument may avoid counts.
+			reach[instr] = clamp(r, bounds[instr])
+		}
+	}
+	if err := checkConstraints(bounds, unconstrained, constraints); err != nil {
+		return nil, err
 	}
-}
 
-type positionVerifier struct {
-	instrumentCurrency string
-	valueUnit          string
-	valueUnitType      string
+	var classes []classBounds
+	if o.assetClasses != nil {
+		classes = classRebalancing(o.assetClasses, instrClass, balances, positionValue, total, closest, o)
+	}
 
-	errs []error
-}
+	sort.Strings(accounts)
+	assetClasses := map[string]string{}
+	for _, dist := range distributions {
+		assetClasses[dist.InstrumentName] = dist.AssetClass
+	}
+	// planBalancer returns the balancer of the plan with the given bounds.
+	planBalancer := func(bounds map[string][2]float64) (balancer, error) {
+		b := newBalancer(balances, bounds, o).withAccounts(accounts, held).withClasses(classes)
+		b.total = total
+		b.cash = make([]bool, len(b.instruments))
+		for i, instr := range b.instruments {
+			b.cash[i] = isCash[instr]
+		}
+		if o.locationCost != nil {
+			var err error
+			if b, err = b.withLocationCost(o.locationCost, accountTypes, assetClasses); err != nil {
+				return b, err
+			}
+		}
+		if closest {
+			cashFlow := 0.0
+			if cashFlowOnly {
+				cashFlow = o.cashFlow
+			}
+			b = b.withReach(cashFlow, reach)
+		}
+		if o.rounding {
+			precision := positions[0].Value.DecimalPrecision
+			for _, pos := range positions {
+				if pos.Value.DecimalPrecision < precision {
+					precision = pos.Value.DecimalPrecision
+				}
+			}
+			b = b.withRounding(precision)
+		}
+		return b, nil
+	}
+	balancer, err := planBalancer(bounds)
+	if err != nil {
+		return nil, err
+	}
+	transfers, err := balancer.optimalTransfers()
+	if errors.Is(err, ErrInfeasible) && len(constraints) > 0 {
+		// Blame the constraints only if the transfers may be found
+		// without them, and not if e.g. a minimum transfer, rounding or
+		// the amounts held in the accounts are what rule them out.
+		relaxed := make(map[string][2]float64, len(bounds))
+		for instr, b := range bounds {
+			relaxed[instr] = b
+		}
+		for instr, b := range unconstrained {
+			relaxed[instr] = b
+		}
+		if b, rerr := planBalancer(relaxed); rerr == nil {
+			if _, rerr := b.optimalTransfers(); rerr == nil {
+				return nil, &ConstraintError{Constraints: constraints}
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{
+		Positions:     positions,
+		Distributions: distributions,
+		Deviations:    make([]Deviation, 0, len(balancer.instruments)),
+		Transfers:     transfers,
+		CashFlow:      o.cashFlow,
+		Unmatched:     unmatched,
+		BaseCurrency:  o.baseCurrency,
 
-// newPositionVerifierSample creates a new positionVerifier based on an
-// arbitrarily selected sample from the given positions slice.
-func newPositionVerifierSample(positions []Position) (*positionVerifier, error) {
-	if len(positions) <= 0 {
-		return nil, errors.New("no positions to sample from")
+		DistributionProblems: problems,
+	}
+	if o.assetClasses != nil {
+		plan.ClassDeviations = classDeviations(o.assetClasses, distributions, balances)
 	}
-	p := positions[0]
-	return &positionVerifier{
-		instrumentCurrency: p.Instrument.Currency,
-		valueUnit:          p.Value.Unit,
-		valueUnitType:      p.Value.UnitType,
-	}, nil
-}
 
-func (v positionVerifier) inspect(p Position) {
-	if v.instrumentCurrency != p.Instrument.Currency {
-		v.errs = append(v.errs, ErrCurrency)
+	for i, instr := range balancer.instruments {
+		if instr == cashFlowInstrument {
+			continue
+		}
+		plan.Deviations = append(plan.Deviations, Deviation{
+			InstrumentName: instr,
+			Amount:         balancer.deviations[i],
+			Band:           bands[instr],
+		})
 	}
-	if v.valueUnit != p.Value.Unit {
-		v.errs = append(v.errs, ErrUnit)
+
+	// instrAmount converts an amount in the base currency to the currency
+	// of an instrument.
+	instrAmount := func(amount float64, instr string) (float64, string) {
+		if rate, ok := instrRates[instr]; ok {
+			return amount / rate, instrCurrency[instr]
+		}
+		return amount, o.baseCurrency
 	}
-	if v.valueUnitType != p.Value.UnitType {
-		v.errs = append(v.errs, ErrUnitType)
+	for i, t := range plan.Transfers {
+		switch {
+		case isCash[t.From]:
+			plan.Transfers[i].Kind = Buy
+		case isCash[t.To]:
+			plan.Transfers[i].Kind = Sell
+		}
+		value := positionValue[t.From]
+		if len(accounts) > 1 && t.From != cashFlowInstrument {
+			value = held[t.Account][t.From]
+		}
+		if value != 0 {
+			plan.Transfers[i].Volume = t.Amount / value
+		}
+		if o.baseCurrency != "" {
+			plan.Transfers[i].FromAmount, plan.Transfers[i].FromCurrency = instrAmount(t.Amount, t.From)
+			plan.Transfers[i].ToAmount, plan.Transfers[i].ToCurrency = instrAmount(t.Amount, t.To)
+		}
 	}
-}
 
-func (v positionVerifier) errors() []error {
-	return v.errs
+	return plan, nil
 }
 
-// Errors that may occur during position verification.
-var (
-	ErrCurrency = errors.New("currency differs")
-	ErrUnit     = errors.New("unit differs")
-	ErrUnitType = errors.New("unit type differs")
-)
-
 type positionSummer struct {
 	sum float64
 }
@@ -140,12 +506,15 @@ func newBalanceCalculator(totalValue float64, dists []Distribution) balanceCalcu
 	return calculator
 }
 
+// includePosition adds the value of the position to the balance of its
+// instrument, which may be held in several positions.
 func (c balanceCalculator) includePosition(pos Position) {
 	instrName := pos.Instrument.Name
-	targetDist := c.instrDist[instrName].Distribution
-	targetValue := targetDist * c.total
-	currentValue := pos.Value.Value
-	c.balances[instrName] = currentValue - targetValue
+	if _, ok := c.balances[instrName]; !ok {
+		targetDist := c.instrDist[instrName].Distribution
+		c.balances[instrName] = -targetDist * c.total
+	}
+	c.balances[instrName] += pos.Value.Value
 }
 
 func (c balanceCalculator) includeDistribution(dist Distribution) {
@@ -163,22 +532,40 @@ func (c balanceCalculator) includeDistribution(dist Distribution) {
 	}
 }
 
+// checkConstraints returns a *ConstraintError if the bounds on the net amounts
+// transferred out of the instruments cannot add up to zero, naming the
+// constraints that narrowed the bounds from those given by unconstrained.
+func checkConstraints(bounds, unconstrained map[string][2]float64, constraints map[string]Constraint) error {
+	lower, upper, scale := 0.0, 0.0, 1.0
+	for _, b := range bounds {
+		lower, upper = lower+b[0], upper+b[1]
+		scale = math.Max(scale, math.Max(math.Abs(b[0]), math.Abs(b[1])))
+	}
+	tol := feasTol * scale
+
+	culprits := map[string]Constraint{}
+	for instr, c := range constraints {
+		if lower > tol && bounds[instr][0] > unconstrained[instr][0] ||
+			upper < -tol && bounds[instr][1] < unconstrained[instr][1] {
+			culprits[instr] = c
+		}
+	}
+	if len(culprits) > 0 {
+		return &ConstraintError{Constraints: culprits}
+	}
+	return nil
+}
+
 func calculateBalances(positions []Position, distributions []Distribution) (map[string]float64, error) {
-	posVerifier, err := newPositionVerifierSample(positions)
-	if err != nil {
-		return nil, err
+	if len(positions) == 0 {
+		return nil, ErrNoPositions
 	}
 
 	posSummer := positionSummer{}
 	for _, position := range positions {
-		posVerifier.inspect(position)
 		posSummer.add(position)
 	}
 
-	if posErrors := posVerifier.errors(); len(posErrors) > 0 {
-		return nil, errors.New("irrecoverable inconsistency detected among positions")
-	}
-
 	balanceCalculator := newBalanceCalculator(posSummer.total(), distributions)
 	for _, position := range positions {
 		balanceCalculator.includePosition(position)
@@ -191,110 +578,892 @@ func calculateBalances(positions []Position, distributions []Distribution) (map[
 	return balanceCalculator.balances, nil
 }
 
-type transfer struct {
-	from   string
-	to     string
-	amount float64
-}
-
 type balancer struct {
-	simplex     *clp.Simplex
+	solver      solver
+	objective   Objective
+	cost        TransferCost
 	instruments []string
 	deviations  []float64
+	// Total value of the positions, if known
+	total float64
+	// Bounds on the net amount to transfer out of each instrument
+	bounds [][2]float64
+	// Whether each instrument is cash
+	cash []bool
+
+	// Amount of money deposited (positive) or withdrawn (negative), if the
+	// transfers are limited to it
+	cashFlow float64
+	// Bounds on the net amount to transfer out of each instrument that take
+	// it to its target, if it is to get as close to it as possible
+	reach [][2]float64
+
+	// Accounts that the instruments are held in
+	accounts []string
+	// Amount held of each instrument per account, which is the most that may
+	// be transferred out of it within the account, if there are several
+	held [][]float64
+	// Cost per amount held of each instrument per account, if any, where
+	// +Inf means that the instrument may not be bought in the account
+	location [][]float64
+
+	// Instruments of each asset class, if rebalanced by class, and the
+	// bounds on, and reach of, the net amount to transfer out of them
+	// together
+	classes     [][]int
+	classBounds [][2]float64
+	classReach  [][2]float64
+
+	// Smallest amount to transfer, if any
+	minTransfer float64
+	// Whether to round the amounts to the number of decimals of precision
+	rounding  bool
+	precision int
+	// Net amount to transfer out of each instrument within each account, if
+	// settled, which then replaces the limits of the amounts held
+	accountNets [][]float64
+	// Amount transferred along each arc by transfers known to be feasible,
+	// if settled from them
+	incumbent map[arc]float64
+	// How long to solve for, and when to take the best transfers found so
+	// far once solving, see WithTimeLimit
+	timeLimit time.Duration
+	deadline  time.Time
 }
 
-func newBalancer(instrDevs map[string]float64) balancer {
+// newBalancer creates a balancer for the given deviations per instrument. The
+// net amount transferred out of each instrument is kept within its bounds,
+// or is equal to its deviation if it has none.
+func newBalancer(instrDevs map[string]float64, instrBounds map[string][2]float64, o options) balancer {
 	balancer := balancer{
-		simplex:     clp.NewSimplex(),
+		solver:      o.solver,
+		objective:   o.objective,
+		cost:        o.transferCost,
+		minTransfer: o.minTransfer,
+		timeLimit:   o.timeLimit,
 		instruments: make([]string, 0, len(instrDevs)),
 		deviations:  make([]float64, 0, len(instrDevs)),
+		bounds:      make([][2]float64, 0, len(instrDevs)),
 	}
-	for instr, dev := range instrDevs {
+	for instr := range instrDevs {
 		balancer.instruments = append(balancer.instruments, instr)
+	}
+	sort.Strings(balancer.instruments)
+	for _, instr := range balancer.instruments {
+		dev := instrDevs[instr]
+		bounds, ok := instrBounds[instr]
+		if !ok {
+			bounds = [2]float64{dev, dev}
+		}
 		balancer.deviations = append(balancer.deviations, dev)
+		balancer.bounds = append(balancer.bounds, bounds)
 	}
 	return balancer
 }
 
-func (b balancer) optimalTransfers() []transfer {
-	b.simplex.EasyLoadDenseProblem(b.obj(), b.varBounds(), b.ineqs())
-	b.simplex.SetOptimizationDirection(clp.Minimize)
-	b.simplex.Primal(clp.NoValuesPass, clp.NoStartFinishOptions)
-	soln := b.simplex.PrimalColumnSolution()
-	return b.translateSolution(soln)
+// withReach makes the balancer get as close to the targets as possible, for
+// when they may not be reachable, where reach holds the bounds on the net
+// amount to transfer out of each instrument that count as reaching its
+// target. A nonzero cash flow limits the transfers to those that invest a
+// deposit or make up a withdrawal of that amount.
+func (b balancer) withReach(cashFlow float64, instrReach map[string][2]float64) balancer {
+	b.cashFlow = cashFlow
+	b.reach = make([][2]float64, len(b.instruments))
+	for i, instr := range b.instruments {
+		b.reach[i] = instrReach[instr]
+	}
+	return b
+}
+
+// withAccounts makes the balancer transfer money only within the given
+// accounts, where held holds the amount held of each instrument per account.
+// With more than one account, the solver chooses which account to transfer
+// within, transferring out of each instrument no more than the account holds.
+func (b balancer) withAccounts(accounts []string, held map[string]map[string]float64) balancer {
+	b.accounts = accounts
+	if len(accounts) < 2 {
+		return b
+	}
+	b.held = make([][]float64, len(accounts))
+	for a, account := range accounts {
+		b.held[a] = make([]float64, len(b.instruments))
+		for i, instr := range b.instruments {
+			b.held[a][i] = held[account][instr]
+		}
+	}
+	return b
+}
+
+// withClasses makes the balancer rebalance the given asset classes, keeping
+// the net amount transferred out of the instruments of each within its
+// bounds, and getting it as close to its reach as possible along with those
+// of the instruments outside any class.
+func (b balancer) withClasses(classes []classBounds) balancer {
+	index := make(map[string]int, len(b.instruments))
+	for i, instr := range b.instruments {
+		index[instr] = i
+	}
+	b.classes, b.classBounds, b.classReach = nil, nil, nil
+	for _, c := range classes {
+		instruments := make([]int, len(c.instruments))
+		for k, instr := range c.instruments {
+			instruments[k] = index[instr]
+		}
+		b.classes = append(b.classes, instruments)
+		b.classBounds = append(b.classBounds, c.bounds)
+		b.classReach = append(b.classReach, c.reach)
+	}
+	return b
+}
+
+// withLocationCost makes the balancer prefer to hold the instruments in the
+// accounts where they are cheapest to hold, where accountTypes holds the
+// type of each account and assetClasses the asset class of each instrument.
+// Cash is free to hold anywhere.
+func (b balancer) withLocationCost(cost LocationCost, accountTypes, assetClasses map[string]string) (balancer, error) {
+	b.location = make([][]float64, len(b.accounts))
+	for a, account := range b.accounts {
+		b.location[a] = make([]float64, len(b.instruments))
+		for i, instr := range b.instruments {
+			if b.cash[i] {
+				continue
+			}
+			c := cost(accountTypes[account], instr, assetClasses[instr])
+			if c < 0 || math.IsNaN(c) {
+				return b, fmt.Errorf("%w of %q in %q: %g", ErrLocationCost, instr, accountTypes[account], c)
+			}
+			b.location[a][i] = c
+		}
+	}
+	return b, nil
 }
 
-// translateSolution converts the given solution into a slice of transfers.
-func (b balancer) translateSolution(soln []float64) []transfer {
-	nonzeroCount := 0
-	for _, amount := range soln {
-		if amount != 0 {
-			nonzeroCount++
+// withRounding makes the balancer round the transferred amounts to the given
+// number of decimals. The bounds of the instruments and asset classes are
+// widened to the closest amounts that may be reached by such transfers, except
+// for the cash flow, which is rounded down, and the minimum transfer is
+// rounded up.
+func (b balancer) withRounding(precision int) balancer {
+	b.rounding, b.precision = true, precision
+	unit := math.Pow10(-precision)
+	b.minTransfer = math.Ceil(b.minTransfer/unit-integerTol) * unit
+	bounds := make([][2]float64, len(b.bounds))
+	for i, instr := range b.instruments {
+		lb := math.Floor(b.bounds[i][0]/unit+integerTol) * unit
+		ub := math.Ceil(b.bounds[i][1]/unit-integerTol) * unit
+		if instr == cashFlowInstrument {
+			ub = lb
 		}
+		bounds[i] = [2]float64{lb, ub}
 	}
+	b.bounds = bounds
+	classBounds := make([][2]float64, len(b.classBounds))
+	for c, cb := range b.classBounds {
+		classBounds[c] = [2]float64{
+			math.Floor(cb[0]/unit+integerTol) * unit,
+			math.Ceil(cb[1]/unit-integerTol) * unit,
+		}
+	}
+	b.classBounds = classBounds
+	return b
+}
 
-	solnIdx, transfers := 0, make([]transfer, 0, nonzeroCount)
-	for i, from := range b.instruments {
-		for j, to := range b.instruments {
-			if i != j {
-				if amount := soln[solnIdx]; amount != 0 {
-					t := transfer{from: from, to: to, amount: soln[solnIdx]}
-					transfers = append(transfers, t)
+// directed returns the balancer with each instrument either only giving or
+// only taking, as it does when getting as close to the targets as possible
+// without a minimum transfer. A minimum transfer may otherwise be met by
+// passing money on through instruments, which only adds to the transfers.
+func (b balancer) directed() (balancer, error) {
+	relaxed := b
+	relaxed.minTransfer, relaxed.rounding = 0, false
+	transfers, err := relaxed.optimalTransfers()
+	if err != nil {
+		return b, err
+	}
+
+	index := make(map[string]int, len(b.instruments))
+	for i, instr := range b.instruments {
+		index[instr] = i
+	}
+	nets := make([]float64, len(b.instruments))
+	for _, t := range transfers {
+		nets[index[t.From]] += t.Amount
+		nets[index[t.To]] -= t.Amount
+	}
+	// Those that neither give nor take do as their deviations would have
+	// them.
+	bounds := make([][2]float64, len(b.bounds))
+	for i, net := range nets {
+		bounds[i] = b.bounds[i]
+		if math.Abs(net) <= dustTol*b.total {
+			net = b.deviations[i]
+		}
+		if net >= 0 {
+			bounds[i][0] = math.Max(bounds[i][0], 0)
+		} else {
+			bounds[i][1] = math.Min(bounds[i][1], 0)
+		}
+	}
+	b.bounds = bounds
+	return b, nil
+}
+
+func (b balancer) optimalTransfers() ([]Transfer, error) {
+	if b.deadline.IsZero() {
+		b.deadline = time.Now().Add(b.timeLimit)
+	}
+	if b.reach != nil && b.minTransfer > 0 {
+		var err error
+		if b, err = b.directed(); err != nil {
+			return nil, err
+		}
+	}
+	arcs := b.arcs()
+	costs, err := b.costs(arcs)
+	if err != nil {
+		return nil, err
+	}
+	p := b.model(arcs, costs)
+
+	// Find how close to the targets the transfers may get, first by the
+	// largest distance of an instrument to its target and then by the sum
+	// of the distances, and then look for the cheapest transfers that get
+	// that close.
+	var stages []closenessStage
+	if b.reach != nil {
+		z := len(arcs)
+		stages = append(stages, closenessStage{cols: []int{z}})
+		dists := closenessStage{}
+		for d := z + 1; d < len(p.obj); d++ {
+			dists.cols = append(dists.cols, d)
+		}
+		stages = append(stages, dists)
+		for i, stage := range stages {
+			stages[i].row = p.addRow(math.Inf(-1), math.Inf(1))
+			for _, j := range stage.cols {
+				p.addCoef(stages[i].row, j, 1)
+			}
+		}
+	}
+	// Transfers are counted once the closeness is settled, but a minimum
+	// transfer limits how close they may get.
+	var integer []bool
+	var incumbent []float64
+	if b.reach == nil || b.minTransfer > 0 {
+		var indicators []int
+		integer, indicators = b.addIndicators(p, arcs)
+		if integer != nil && b.incumbent != nil {
+			incumbent = make([]float64, len(p.obj))
+			for k, a := range arcs {
+				incumbent[k] = b.incumbent[a]
+				if incumbent[k] > 0 && indicators[k] >= 0 {
+					incumbent[indicators[k]] = 1
 				}
-				solnIdx++
 			}
 		}
 	}
 
-	return transfers
+	// Each stage starts from the solution of the one before, which is
+	// feasible with it being as close to the targets as it got.
+	for _, stage := range stages {
+		closeness := *p
+		closeness.obj = make([]float64, len(p.obj))
+		for _, j := range stage.cols {
+			closeness.obj[j] = 1.0
+		}
+		soln, err := b.solve(&closeness, integer, incumbent)
+		if err != nil {
+			return nil, err
+		}
+		incumbent = soln
+
+		distance := 0.0
+		for _, j := range stage.cols {
+			distance += soln[j]
+		}
+		p.rowBounds[stage.row][1] = distance + closenessTol*math.Max(1, distance)
+	}
+
+	soln, err := b.solve(p, integer, incumbent)
+	if err != nil {
+		return nil, err
+	}
+	if b.reach != nil {
+		return b.settledTransfers(arcs, soln)
+	}
+
+	transfers := b.translateSolution(arcs, soln)
+	if err := b.checkResidual(transfers); err != nil {
+		return nil, b.solverError(err, p, integer)
+	}
+	return transfers, nil
+}
+
+// settledTransfers fixes the net amounts transferred out of the instruments
+// to those of the given solution and finds the optimal transfers that move
+// exactly those amounts. When rounding, the net amounts are rounded to whole
+// units, keeping their sum, so that the transfers are of whole units too
+// since the bounds of the min-cost flow problem are. With several accounts,
+// so are the net amounts within each account, see roundAccountNets.
+func (b balancer) settledTransfers(arcs []arc, soln []float64) ([]Transfer, error) {
+	unit := 1.0
+	if b.rounding {
+		unit = math.Pow10(-b.precision)
+	}
+	units := make([]float64, len(b.instruments))
+	for k, a := range arcs {
+		if soln[k] <= dustTol*b.total {
+			continue
+		}
+		units[a.from] += soln[k] / unit
+		units[a.to] -= soln[k] / unit
+	}
+
+	if b.rounding {
+		// Round down and then up the instruments with the largest
+		// remainders until the units add up to zero again.
+		sum, order := 0.0, make([]int, 0, len(units))
+		remainders := make([]float64, len(units))
+		for i, u := range units {
+			rounded := math.Floor(u + integerTol)
+			remainders[i], units[i] = u-rounded, rounded
+			sum += rounded
+			if b.instruments[i] != cashFlowInstrument {
+				order = append(order, i)
+			}
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return remainders[order[i]] > remainders[order[j]]
+		})
+		for k := 0; k < int(math.Round(-sum)) && k < len(order); k++ {
+			units[order[k]]++
+		}
+	}
+
+	settled := b
+	settled.reach = nil
+	settled.classes, settled.classBounds, settled.classReach = nil, nil, nil
+	settled.incumbent = make(map[arc]float64, len(arcs))
+	for k, a := range arcs {
+		if soln[k] > dustTol*b.total {
+			settled.incumbent[a] = soln[k]
+		}
+	}
+	settled.bounds = make([][2]float64, len(units))
+	for i, u := range units {
+		settled.bounds[i] = [2]float64{u * unit, u * unit}
+	}
+	if !b.rounding || b.held == nil {
+		return settled.optimalTransfers()
+	}
+
+	// With several accounts, the transfers are first found unrounded and
+	// then once more with the net amounts of the instruments within each
+	// account settled to whole units, which the transfers of a min-cost
+	// flow problem then are too.
+	settled.rounding = false
+	transfers, err := settled.optimalTransfers()
+	if err != nil {
+		return nil, err
+	}
+	if settled.accountNets, err = b.roundAccountNets(transfers, units); err != nil {
+		return nil, err
+	}
+	settled.rounding = true
+	return settled.optimalTransfers()
+}
+
+// roundAccountNets returns the net amounts transferred out of the instruments
+// within each account by the transfers rounded to whole units, such that
+// they still add up to zero within each account and to the given units per
+// instrument across the accounts. As each net amount is rounded either up or
+// down, which is a flow problem of its own, the rounding is solved for.
+func (b balancer) roundAccountNets(transfers []Transfer, units []float64) ([][]float64, error) {
+	unit := math.Pow10(-b.precision)
+	index, accountIndex := make(map[string]int, len(b.instruments)), make(map[string]int, len(b.accounts))
+	for i, instr := range b.instruments {
+		index[instr] = i
+	}
+	for a, account := range b.accounts {
+		accountIndex[account] = a
+	}
+	nets := make([][]float64, len(b.accounts))
+	for a := range nets {
+		nets[a] = make([]float64, len(b.instruments))
+	}
+	for _, t := range transfers {
+		a := accountIndex[t.Account]
+		nets[a][index[t.From]] += t.Amount / unit
+		nets[a][index[t.To]] -= t.Amount / unit
+	}
+
+	p := &problem{}
+	accountRows := make([]int, len(b.accounts))
+	for a := range accountRows {
+		accountRows[a] = p.addRow(0, 0)
+	}
+	instrRows := make([]int, len(b.instruments))
+	for i, u := range units {
+		instrRows[i] = p.addRow(u, u)
+	}
+	cols := make([][]int, len(b.accounts))
+	for a, net := range nets {
+		cols[a] = make([]int, len(net))
+		for i, n := range net {
+			cols[a][i] = p.addCol(0, math.Floor(n+integerTol), math.Ceil(n-integerTol),
+				nonzero{row: accountRows[a], val: 1}, nonzero{row: instrRows[i], val: 1})
+		}
+	}
+	soln, _, status := b.solver.solve(p)
+	if err := status.err(); err != nil {
+		return nil, b.solverError(err, p, nil)
+	}
+
+	for a := range nets {
+		for i := range nets[a] {
+			nets[a][i] = math.Round(soln[cols[a][i]]) * unit
+		}
+	}
+	return nets, nil
 }
 
-func (b balancer) nVars() int {
-	return len(b.deviations) * (len(b.deviations) - 1)
+// closenessStage is a stage of getting as close to the targets as possible,
+// in which the sum of the distance columns is minimized and then bounded by
+// the row.
+type closenessStage struct {
+	cols []int
+	row  int
 }
 
-// obj returns the coefficients of the objective function.
-func (b balancer) obj() []float64 {
-	obj := make([]float64, b.nVars())
-	for i := range obj {
-		obj[i] = 1.0
+// closenessTol is how much farther from the targets than the closest possible
+// the transfers may get, relative to the distance, to allow for rounding
+// errors.
+const closenessTol = 1e-12
+
+// solve solves the problem, as a mixed-integer program if any of its columns
+// are integer, starting from the incumbent if it is feasible.
+func (b balancer) solve(p *problem, integer []bool, incumbent []float64) ([]float64, error) {
+	var soln []float64
+	var status lpStatus
+	for _, isInteger := range integer {
+		if isInteger {
+			soln, status = mip{
+				problem:   p,
+				integer:   integer,
+				solver:    b.solver,
+				incumbent: incumbent,
+				deadline:  b.deadline,
+			}.solve()
+			break
+		}
+	}
+	if soln == nil && status == lpOptimal {
+		soln, _, status = b.solver.solve(p)
+	}
+
+	if err := status.err(); err != nil {
+		return nil, b.solverError(err, p, integer)
 	}
-	return obj
+	return soln, nil
 }
 
-// varBounds returns the lower and upper bounds on each variable.
-func (b balancer) varBounds() [][2]float64 {
-	varBounds := make([][2]float64, b.nVars())
-	for i := range varBounds {
-		varBounds[i] = [2]float64{0, math.Inf(1)}
+// solverError returns a *SolverError of the given cause that holds the
+// problem with the arcs and instruments of the balancer named.
+func (b balancer) solverError(err error, p *problem, integer []bool) error {
+	instrName := func(i int) string {
+		if b.instruments[i] == cashFlowInstrument {
+			return "cash_flow"
+		}
+		return lpName(b.instruments[i])
+	}
+	arcs := b.arcs()
+	colName := func(j int) string {
+		if j < len(arcs) {
+			return fmt.Sprintf("x%d_%s_%s", j, instrName(arcs[j].from), instrName(arcs[j].to))
+		}
+		return fmt.Sprintf("c%d", j)
+	}
+	rowName := func(i int) string {
+		if i < len(b.instruments) {
+			return fmt.Sprintf("b%d_%s", i, instrName(i))
+		}
+		return fmt.Sprintf("r%d", i)
+	}
+	return &SolverError{
+		Err:   err,
+		Model: p.format(integer, colName, rowName),
 	}
-	return varBounds
 }
 
-// ineqs returns a matrix in which each row is of the form {lower bound, var_1,
-// var_2, …, var_N, upper bound}.
-func (b balancer) ineqs() [][]float64 {
-	ineqs := NewMatrix(len(b.deviations), b.nVars()+2) // ||{lb,up}|| == 2
-	block := NewMatrix(len(b.deviations), len(b.deviations)-1)
-	ones := NewMatrix(1, block.columnsCount()).withValues(1.0)
-	eye := NewMatrix(len(b.deviations)-1, len(b.deviations)-1).withEyeValues(-1.0)
-	block.setBlock(ones, 0, 0)
-	block.setBlock(eye, 1, 0)
+// lpName replaces the characters of s that may not be part of a name in LP
+// format, including any non-ASCII letters, with underscores.
+func lpName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return r
+		}
+		return '_'
+	}, s)
+}
 
-	colOffset := 1
-	for i := 0; i < block.rowsCount()-1; i++ {
-		ineqs.setBlock(block, 0, colOffset)
-		block.swapRows(i, i+1)
-		colOffset += block.columnsCount()
+// checkResidual returns a *ResidualError if the transfers do not take each
+// instrument within its bounds, allowing for the amounts dropped as dust.
+func (b balancer) checkResidual(transfers []Transfer) error {
+	net := make(map[string]float64, len(b.instruments))
+	for _, t := range transfers {
+		net[t.From] += t.Amount
+		net[t.To] -= t.Amount
 	}
-	ineqs.setBlock(block, 0, colOffset)
+	for i, instr := range b.instruments {
+		lb, ub := b.bounds[i][0], b.bounds[i][1]
+		tol := residualTol*math.Max(1, math.Max(math.Abs(lb), math.Abs(ub))) +
+			float64(len(b.instruments))*dustTol*b.total
+		if got := net[instr]; got < lb-tol || got > ub+tol {
+			return &ResidualError{Instrument: instr, Want: b.bounds[i], Got: got}
+		}
+	}
+	return nil
+}
+
+// residualTol is how far outside its bounds the transfers may take an
+// instrument, relative to the bounds, to allow for numerical errors.
+const residualTol = 1e-6
 
-	bounds := NewMatrix(ineqs.rowsCount(), 1)
-	for i, deviation := range b.deviations {
-		bounds.set(i, 0, deviation)
+// dustTol is the smallest amount to transfer, relative to the total value,
+// below which amounts are taken to be numerical errors and are dropped.
+const dustTol = 1e-9
+
+// addIndicators adds a binary indicator column y per arc x to the model if the
+// transfers are counted or have a minimum amount m, such that m·y ≤ x ≤ M·y,
+// where M is the largest amount that may be transferred along the arc. When
+// counted, each transfer weighs heavier than the cost of all transfers could
+// be, so that the cost is a tie-breaker. It returns which columns of the
+// model are integer, if any, and the indicator of each arc, or -1 for the
+// arcs that may not be transferred along.
+func (b balancer) addIndicators(p *problem, arcs []arc) ([]bool, []int) {
+	count := b.objective == MinimizeCount
+	if !count && b.minTransfer == 0 {
+		return nil, nil
 	}
-	ineqs.setBlock(bounds, 0, 0)
-	ineqs.setBlock(bounds, 0, ineqs.columnsCount()-1)
 
-	return ineqs.nestedSlices()
+	caps := b.capacities(arcs)
+	weight := 0.0
+	if count {
+		weight = 1.0
+		for k, c := range caps {
+			weight += c * math.Abs(p.obj[k])
+		}
+	}
+
+	integer := make([]bool, len(p.obj)+len(arcs))
+	indicators := make([]int, len(arcs))
+	for k, c := range caps {
+		indicators[k] = -1
+		if c < b.minTransfer {
+			p.colBounds[k][1] = 0
+			continue
+		}
+		p.colBounds[k][1] = math.Min(p.colBounds[k][1], c)
+
+		y := p.addCol(weight, 0, 1)
+		integer[y], indicators[k] = true, y
+		row := p.addRow(math.Inf(-1), 0)
+		p.addCoef(row, k, 1)
+		p.addCoef(row, y, -c)
+		if b.minTransfer > 0 {
+			row := p.addRow(0, math.Inf(1))
+			p.addCoef(row, k, 1)
+			p.addCoef(row, y, -b.minTransfer)
+		}
+	}
+	return integer[:len(p.obj)], indicators
+}
+
+// arc is an ordered pair of instruments that money may be transferred
+// between within an account.
+type arc struct {
+	from, to int
+	account  int
+}
+
+// arcs returns the arcs of the balancer in order of their accounts, their
+// sending and then their receiving instruments. Money is only transferred
+// directly from the instruments that may give, and that are held in the
+// account, to the instruments that may take, and if limited to a cash flow
+// only as buys when depositing and as sells when withdrawing. Instruments
+// that are to be moved between accounts, for their location costs, may give
+// and take in each account as long as their net amounts stay in bounds, but
+// never in instruments that may not be bought in the account.
+func (b balancer) arcs() []arc {
+	var arcs []arc
+	for a := 0; a < len(b.held) || a == 0; a++ {
+		arcs = append(arcs, b.accountArcs(a)...)
+	}
+	return arcs
+}
+
+// accountArcs returns the arcs of the balancer within an account.
+func (b balancer) accountArcs(account int) []arc {
+	relocate := func(i int) bool {
+		return b.location != nil && b.held != nil && b.instruments[i] != cashFlowInstrument
+	}
+	var arcs []arc
+	for i, from := range b.bounds {
+		if from[1] <= 0 && !relocate(i) || b.held != nil && b.held[account][i] <= 0 && b.instruments[i] != cashFlowInstrument {
+			continue
+		}
+		for j, to := range b.bounds {
+			if i == j || to[0] >= 0 && !relocate(j) || b.location != nil && math.IsInf(b.location[account][j], 1) {
+				continue
+			}
+			if b.cashFlow != 0 {
+				buy := b.cash[i] && b.instruments[j] != cashFlowInstrument
+				sell := b.cash[j] && b.instruments[i] != cashFlowInstrument
+				if b.cashFlow > 0 && !buy || b.cashFlow < 0 && !sell {
+					continue
+				}
+			}
+			arcs = append(arcs, arc{from: i, to: j, account: account})
+		}
+	}
+	return arcs
+}
+
+// costs returns the cost per amount transferred along each arc. Without a
+// transfer cost, it is 1 for all arcs, so that the total transferred amount
+// is minimized. Otherwise, the total transferred amount is a tie-breaker.
+//
+// With location costs, the cost of an arc also includes how much more, or
+// less, the amount transferred costs to hold in the receiving instrument
+// than in the sending one, so that the total cost of holding the instruments
+// after the transfers is minimized too. The transferred amount is then only a
+// tie-breaker, unless there is a transfer cost, so that any difference in
+// location cost is worth transferring for. Instruments that may not be bought
+// in an account are taken to be free to hold there when selling them.
+func (b balancer) costs(arcs []arc) ([]float64, error) {
+	costs := make([]float64, len(arcs))
+	for k, a := range arcs {
+		switch {
+		case b.cost == nil && b.location != nil:
+			costs[k] = amountTieBreaker
+		case b.cost == nil:
+			costs[k] = 1.0
+		default:
+			from, to := b.instruments[a.from], b.instruments[a.to]
+			cost := b.cost(from, to)
+			if cost < 0 || math.IsNaN(cost) {
+				return nil, fmt.Errorf("%w from %q to %q: %g", ErrTransferCost, from, to, cost)
+			}
+			costs[k] = cost + amountTieBreaker
+		}
+		if b.location != nil {
+			held := b.location[a.account][a.from]
+			if math.IsInf(held, 1) {
+				held = 0
+			}
+			costs[k] += b.location[a.account][a.to] - held
+		}
+	}
+	return costs, nil
+}
+
+// amountTieBreaker is the cost per amount added to each transfer cost, so
+// that the smallest of the cheapest transfers are found.
+const amountTieBreaker = 1e-6
+
+// model returns the balancer as a min-cost flow problem. Each arc is a column
+// of the amount transferred along it at its cost, and each instrument a row
+// that keeps the net amount transferred out of it within its bounds. With
+// several accounts, each instrument held in an account is also a row that
+// keeps the net amount transferred out of it within the account within the
+// amount held, or each instrument in each account a row that fixes it, once
+// settled. Each asset class rebalanced by the balancer is a row that keeps
+// the net amount transferred out of its instruments within its bounds, to
+// which transfers within the class do not count.
+//
+// When getting as close to the targets as possible, the arcs are followed by
+// a column z of the largest distance from an instrument or class to its
+// target that remains after the transfers, and by a column per instrument
+// outside any class, and then per class, that may give or take of its own
+// such distance, which is bounded by z. Each distance is bounded from below
+// by both the excess and the shortfall of an instrument, since it may pass
+// its target, and by the excess of a class that may give and the shortfall
+// of one that may take.
+func (b balancer) model(arcs []arc, costs []float64) *problem {
+	p := &problem{}
+	for _, bounds := range b.bounds {
+		p.addRow(bounds[0], bounds[1])
+	}
+	for k, a := range arcs {
+		p.addCol(costs[k], 0, math.Inf(1), nonzero{row: a.from, val: 1}, nonzero{row: a.to, val: -1})
+	}
+	if b.held != nil {
+		heldRows := map[[2]int]int{}
+		for a, held := range b.held {
+			for i, amount := range held {
+				switch {
+				case b.accountNets != nil:
+					net := b.accountNets[a][i]
+					heldRows[[2]int{a, i}] = p.addRow(net, net)
+				case amount > 0 && b.instruments[i] != cashFlowInstrument:
+					heldRows[[2]int{a, i}] = p.addRow(math.Inf(-1), amount)
+				}
+			}
+		}
+		for k, a := range arcs {
+			if row, ok := heldRows[[2]int{a.account, a.from}]; ok {
+				p.addCoef(row, k, 1)
+			}
+			if row, ok := heldRows[[2]int{a.account, a.to}]; ok {
+				p.addCoef(row, k, -1)
+			}
+		}
+	}
+	classRows := make([]int, len(b.classes))
+	members := make([][]bool, len(b.classes))
+	for c, instruments := range b.classes {
+		classRows[c] = p.addRow(b.classBounds[c][0], b.classBounds[c][1])
+		members[c] = make([]bool, len(b.instruments))
+		for _, i := range instruments {
+			members[c][i] = true
+		}
+		for k, a := range arcs {
+			if members[c][a.from] != members[c][a.to] {
+				if members[c][a.from] {
+					p.addCoef(classRows[c], k, 1)
+				} else {
+					p.addCoef(classRows[c], k, -1)
+				}
+			}
+		}
+	}
+	if b.reach == nil {
+		return p
+	}
+
+	gives, takes := make([]bool, len(b.instruments)), make([]bool, len(b.instruments))
+	for _, a := range arcs {
+		gives[a.from], takes[a.to] = true, true
+	}
+	inClass := make([]bool, len(b.instruments))
+	for _, instruments := range b.classes {
+		for _, i := range instruments {
+			inClass[i] = true
+		}
+	}
+
+	z := p.addCol(0, 0, math.Inf(1))
+	excessRows, shortfallRows := make([]int, len(b.instruments)), make([]int, len(b.instruments))
+	for i, instr := range b.instruments {
+		excessRows[i], shortfallRows[i] = -1, -1
+		if instr == cashFlowInstrument || inClass[i] || !gives[i] && !takes[i] {
+			continue
+		}
+		d := p.addCol(0, 0, math.Inf(1))
+		row := p.addRow(math.Inf(-1), 0)
+		p.addCoef(row, d, 1)
+		p.addCoef(row, z, -1)
+		excessRows[i] = p.addRow(b.reach[i][0], math.Inf(1))
+		p.addCoef(excessRows[i], d, 1)
+		shortfallRows[i] = p.addRow(math.Inf(-1), b.reach[i][1])
+		p.addCoef(shortfallRows[i], d, -1)
+	}
+	for k, a := range arcs {
+		for _, row := range []int{excessRows[a.from], shortfallRows[a.from]} {
+			if row >= 0 {
+				p.addCoef(row, k, 1)
+			}
+		}
+		for _, row := range []int{excessRows[a.to], shortfallRows[a.to]} {
+			if row >= 0 {
+				p.addCoef(row, k, -1)
+			}
+		}
+	}
+
+	for c := range b.classes {
+		classGives, classTakes := false, false
+		for _, a := range arcs {
+			if members[c][a.from] != members[c][a.to] {
+				classGives = classGives || members[c][a.from]
+				classTakes = classTakes || members[c][a.to]
+			}
+		}
+		if !classGives && !classTakes {
+			continue
+		}
+		d := p.addCol(0, 0, math.Inf(1))
+		row := p.addRow(math.Inf(-1), 0)
+		p.addCoef(row, d, 1)
+		p.addCoef(row, z, -1)
+		var rows []int
+		if classGives {
+			row := p.addRow(b.classReach[c][0], math.Inf(1))
+			p.addCoef(row, d, 1)
+			rows = append(rows, row)
+		}
+		if classTakes {
+			row := p.addRow(math.Inf(-1), b.classReach[c][1])
+			p.addCoef(row, d, -1)
+			rows = append(rows, row)
+		}
+		for k, a := range arcs {
+			if members[c][a.from] == members[c][a.to] {
+				continue
+			}
+			val := -1.0
+			if members[c][a.from] {
+				val = 1
+			}
+			for _, row := range rows {
+				p.addCoef(row, k, val)
+			}
+		}
+	}
+	return p
+}
+
+// capacities returns the largest amount that may be transferred along each
+// arc, i.e. the smallest of the most that the sending instrument may give and
+// the most that the receiving instrument may take, and of the amount held of
+// the sending instrument in the account if there are several. With location
+// costs, only the amount held limits the arcs, as money may also pass
+// through instruments between the accounts.
+func (b balancer) capacities(arcs []arc) []float64 {
+	caps := make([]float64, len(arcs))
+	for k, a := range arcs {
+		caps[k] = math.Min(b.bounds[a.from][1], -b.bounds[a.to][0])
+		if b.held != nil && b.instruments[a.from] != cashFlowInstrument {
+			if b.location != nil {
+				caps[k] = b.held[a.account][a.from]
+			} else {
+				caps[k] = math.Min(caps[k], b.held[a.account][a.from])
+			}
+		}
+	}
+	return caps
+}
+
+// translateSolution converts the amounts of the given solution that are
+// transferred along the arcs into a slice of transfers, leaving out amounts
+// too small to be more than numerical errors, see dustTol.
+func (b balancer) translateSolution(arcs []arc, soln []float64) []Transfer {
+	var transfers []Transfer
+	for k, a := range arcs {
+		amount := soln[k]
+		if b.rounding {
+			amount = math.Round(amount*math.Pow10(b.precision)) / math.Pow10(b.precision)
+		}
+		if amount > dustTol*b.total {
+			transfer := Transfer{
+				From:   b.instruments[a.from],
+				To:     b.instruments[a.to],
+				Amount: amount,
+			}
+			if len(b.accounts) > 0 {
+				transfer.Account = b.accounts[a.account]
+			}
+			transfers = append(transfers, transfer)
+		}
+	}
+	return transfers
 }
@@ -1,7 +1,13 @@
 package transfers
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestCalculateBalances(t *testing.T) {
@@ -92,3 +98,1293 @@ func TestCalculateBalances_NonOverlapping(t *testing.T) {
 		t.Errorf("balances[C fund] = %f, want %f", got, want)
 	}
 }
+
+func TestCalculate(t *testing.T) {
+	positions := []Position{
+		{
+			ID:         "A",
+			Instrument: Fund{BaseInstrument{Name: "A fund"}},
+			Value:      Value{Value: 100.00},
+		},
+		{
+			ID:         "B",
+			Instrument: Fund{BaseInstrument{Name: "B fund"}},
+			Value:      Value{Value: 200.00},
+		},
+		{
+			ID:         "C",
+			Instrument: Fund{BaseInstrument{Name: "C fund"}},
+			Value:      Value{Value: 300.00},
+		},
+	}
+	distributions := []Distribution{
+		{
+			InstrumentName: "A fund",
+			Distribution:   0.10,
+		},
+		{
+			InstrumentName: "B fund",
+			Distribution:   0.50,
+		},
+		{
+			InstrumentName: "C fund",
+			Distribution:   0.40,
+		},
+	}
+	plan, err := Calculate(positions, distributions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantDeviations := []Deviation{
+		{InstrumentName: "A fund", Amount: 40},
+		{InstrumentName: "B fund", Amount: -100},
+		{InstrumentName: "C fund", Amount: 60},
+	}
+	if want, got := len(wantDeviations), len(plan.Deviations); want != got {
+		t.Fatalf("len(plan.Deviations) = %d, want %d", got, want)
+	}
+	for i, want := range wantDeviations {
+		if got := plan.Deviations[i]; want != got {
+			t.Errorf("plan.Deviations[%d] = %v, want %v", i, got, want)
+		}
+	}
+
+	wantTransfers := []Transfer{
+		{From: "A fund", To: "B fund", Amount: 40, Volume: 0.4},
+		{From: "C fund", To: "B fund", Amount: 60, Volume: 0.2},
+	}
+	if want, got := len(wantTransfers), len(plan.Transfers); want != got {
+		t.Fatalf("len(plan.Transfers) = %d, want %d", got, want)
+	}
+	for i, want := range wantTransfers {
+		if got := plan.Transfers[i]; want != got {
+			t.Errorf("plan.Transfers[%d] = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestCalculate_NoPositions(t *testing.T) {
+	distributions := []Distribution{{InstrumentName: "A fund", Distribution: 1}}
+	if _, err := Calculate(nil, distributions); err != ErrNoPositions {
+		t.Errorf("Calculate() error = %v, want %v", err, ErrNoPositions)
+	}
+}
+
+func TestCalculate_MinimizeCount(t *testing.T) {
+	positions := []Position{
+		{ID: "A", Instrument: Fund{BaseInstrument{Name: "A fund"}}, Value: Value{Value: 130.00}},
+		{ID: "B", Instrument: Fund{BaseInstrument{Name: "B fund"}}, Value: Value{Value: 170.00}},
+		{ID: "C", Instrument: Fund{BaseInstrument{Name: "C fund"}}, Value: Value{Value: 30.00}},
+		{ID: "D", Instrument: Fund{BaseInstrument{Name: "D fund"}}, Value: Value{Value: 70.00}},
+	}
+	distributions := []Distribution{
+		{InstrumentName: "A fund", Distribution: 0.25},
+		{InstrumentName: "B fund", Distribution: 0.25},
+		{InstrumentName: "C fund", Distribution: 0.25},
+		{InstrumentName: "D fund", Distribution: 0.25},
+	}
+	plan, err := Calculate(positions, distributions, WithObjective(MinimizeCount))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantTransfers := []Transfer{
+		{From: "A fund", To: "D fund", Amount: 30, Volume: 30. / 130},
+		{From: "B fund", To: "C fund", Amount: 70, Volume: 70. / 170},
+	}
+	if want, got := len(wantTransfers), len(plan.Transfers); want != got {
+		t.Fatalf("len(plan.Transfers) = %d, want %d: %v", got, want, plan.Transfers)
+	}
+	for i, want := range wantTransfers {
+		if got := plan.Transfers[i]; want != got {
+			t.Errorf("plan.Transfers[%d] = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestCalculate_MinimizeCount_ManyInstruments(t *testing.T) {
+	var positions []Position
+	var distributions []Distribution
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("Fund %02d", i)
+		positions = append(positions, Position{
+			ID:         name,
+			Instrument: Fund{BaseInstrument{Name: name}},
+			Value:      Value{Value: 100 + 25*float64(i*37%41)},
+		})
+		distributions = append(distributions, Distribution{InstrumentName: name, Distribution: 1. / 40})
+	}
+
+	// The fewest transfers found within the time limit are taken, which are
+	// never more than one less than the instruments.
+	start := time.Now()
+	plan, err := Calculate(positions, distributions,
+		WithObjective(MinimizeCount), WithTimeLimit(500*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Errorf("Calculate took %v", elapsed)
+	}
+	if got := len(plan.Transfers); got > 39 {
+		t.Errorf("len(plan.Transfers) = %d, want at most %d", got, 39)
+	}
+	want := 0.0
+	for _, p := range positions {
+		want += p.Value.Value / 40
+	}
+	for instr, got := range applyTransfers(positions, plan.Transfers) {
+		if math.Abs(want-got) > 1e-6 {
+			t.Errorf("value of %s = %v, want %v", instr, got, want)
+		}
+	}
+}
+
+func TestCalculate_Tolerance(t *testing.T) {
+	positions := []Position{
+		{ID: "A", Instrument: Fund{BaseInstrument{Name: "A fund"}}, Value: Value{Value: 100.00}},
+		{ID: "B", Instrument: Fund{BaseInstrument{Name: "B fund"}}, Value: Value{Value: 200.00}},
+		{ID: "C", Instrument: Fund{BaseInstrument{Name: "C fund"}}, Value: Value{Value: 300.00}},
+	}
+	distributions := []Distribution{
+		{InstrumentName: "A fund", Distribution: 0.10}, // target value: 60
+		{InstrumentName: "B fund", Distribution: 0.50}, // target value: 300
+		{InstrumentName: "C fund", Distribution: 0.40}, // target value: 240
+	}
+
+	// All instruments are outside of their bands: A ± 12, B ± 60, C ± 48.
+	plan, err := Calculate(positions, distributions,
+		WithTolerance(Tolerance{Relative: 0.2}), WithRebalanceMode(RebalanceToEdge))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTransfers := []Transfer{
+		{From: "A fund", To: "B fund", Amount: 28},
+		{From: "C fund", To: "B fund", Amount: 12},
+	}
+	if want, got := len(wantTransfers), len(plan.Transfers); want != got {
+		t.Fatalf("len(plan.Transfers) = %d, want %d: %v", got, want, plan.Transfers)
+	}
+	for i, want := range wantTransfers {
+		got := plan.Transfers[i]
+		if want.From != got.From || want.To != got.To || math.Abs(want.Amount-got.Amount) > 1e-9 {
+			t.Errorf("plan.Transfers[%d] = %v, want %v", i, got, want)
+		}
+	}
+
+	// All instruments are within their bands of ± 120.
+	plan, err = Calculate(positions, distributions, WithTolerance(Tolerance{Absolute: 0.2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(plan.Transfers); got != 0 {
+		t.Errorf("len(plan.Transfers) = %d, want 0: %v", got, plan.Transfers)
+	}
+}
+
+func TestCalculate_Deposit(t *testing.T) {
+	positions := []Position{
+		{ID: "A", Instrument: Fund{BaseInstrument{Name: "A fund"}}, Value: Value{Value: 100.00}},
+		{ID: "B", Instrument: Fund{BaseInstrument{Name: "B fund"}}, Value: Value{Value: 100.00}},
+		{ID: "C", Instrument: Fund{BaseInstrument{Name: "C fund"}}, Value: Value{Value: 400.00}},
+	}
+	distributions := []Distribution{
+		{InstrumentName: "A fund", Distribution: 1. / 3}, // target value: 250
+		{InstrumentName: "B fund", Distribution: 1. / 3}, // target value: 250
+		{InstrumentName: "C fund", Distribution: 1. / 3}, // target value: 250
+	}
+
+	// C stays above its target since only buys are allowed, while A and B
+	// are brought equally close to theirs.
+	plan, err := Calculate(positions, distributions, WithDeposit(150))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTransfers(t, plan.Transfers, []Transfer{
+		{Kind: Buy, From: "", To: "A fund", Amount: 75},
+		{Kind: Buy, From: "", To: "B fund", Amount: 75},
+	})
+	for _, tr := range plan.Transfers {
+		if want, got := Buy, tr.Kind; want != got {
+			t.Errorf("%v.Kind = %v, want %v", tr, got, want)
+		}
+	}
+
+	// Switches let all instruments reach their targets.
+	plan, err = Calculate(positions, distributions, WithDeposit(150), WithSwitches())
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := applyTransfers(positions, plan.Transfers)
+	for _, instr := range []string{"A fund", "B fund", "C fund"} {
+		if want, got := 250., values[instr]; math.Abs(want-got) > 1e-9 {
+			t.Errorf("value of %s after transfers = %f, want %f", instr, got, want)
+		}
+	}
+}
+
+func TestCalculate_Withdrawal(t *testing.T) {
+	positions := []Position{
+		{ID: "A", Instrument: Fund{BaseInstrument{Name: "A fund"}}, Value: Value{Value: 300.00}},
+		{ID: "B", Instrument: Fund{BaseInstrument{Name: "B fund"}}, Value: Value{Value: 100.00}},
+		{ID: "C", Instrument: Fund{BaseInstrument{Name: "C fund"}}, Value: Value{Value: 100.00}},
+	}
+	distributions := []Distribution{
+		{InstrumentName: "A fund", Distribution: 0.5}, // target value: 175
+		{InstrumentName: "B fund", Distribution: 0.5}, // target value: 175
+	}
+
+	// B stays below its target since only sells are allowed, while A and C
+	// are brought equally close to theirs.
+	plan, err := Calculate(positions, distributions, WithWithdrawal(150))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTransfers(t, plan.Transfers, []Transfer{
+		{Kind: Sell, From: "A fund", To: "", Amount: 87.5, Volume: 87.5 / 300},
+		{Kind: Sell, From: "C fund", To: "", Amount: 62.5, Volume: 62.5 / 100},
+	})
+
+	if _, err := Calculate(positions, distributions, WithWithdrawal(1000)); err != ErrWithdrawal {
+		t.Errorf("Calculate() error = %v, want %v", err, ErrWithdrawal)
+	}
+	for _, opt := range []Option{WithDeposit(-50), WithWithdrawal(-50), WithDeposit(math.NaN())} {
+		if _, err := Calculate(positions, distributions, opt); !errors.Is(err, ErrCashFlow) {
+			t.Errorf("Calculate() error = %v, want %v", err, ErrCashFlow)
+		}
+	}
+}
+
+// applyTransfers returns the value of each instrument after the transfers.
+func applyTransfers(positions []Position, transfers []Transfer) map[string]float64 {
+	values := map[string]float64{}
+	for _, p := range positions {
+		values[p.Instrument.Name] += p.Value.Value
+	}
+	for _, tr := range transfers {
+		values[tr.From] -= tr.Amount
+		values[tr.To] += tr.Amount
+	}
+	return values
+}
+
+func transferredAmount(plan *Plan) float64 {
+	amount := 0.0
+	for _, t := range plan.Transfers {
+		amount += t.Amount
+	}
+	return amount
+}
+
+func assertTransfers(t *testing.T, got, want []Transfer) {
+	t.Helper()
+	if len(want) != len(got) {
+		t.Fatalf("transfers = %v, want %v", got, want)
+	}
+	for i := range want {
+		if want[i].Kind != got[i].Kind || want[i].Account != got[i].Account || want[i].From != got[i].From || want[i].To != got[i].To ||
+			math.Abs(want[i].Amount-got[i].Amount) > 1e-9 ||
+			math.Abs(want[i].Volume-got[i].Volume) > 1e-9 && want[i].Volume != 0 {
+			t.Errorf("transfers[%d] = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestCalculate_Cash(t *testing.T) {
+	positions := []Position{
+		{ID: "A", Instrument: Fund{BaseInstrument{Name: "A fund"}}, Value: Value{Value: 100.00}},
+		{ID: "B", Instrument: Fund{BaseInstrument{Name: "B fund"}}, Value: Value{Value: 100.00}},
+		{ID: "C", Instrument: Fund{BaseInstrument{Name: CashName, Type: TypeCash}}, Value: Value{Value: 200.00}},
+	}
+	distributions := []Distribution{
+		{InstrumentName: "A fund", Distribution: 0.5},
+		{InstrumentName: "B fund", Distribution: 0.5},
+	}
+
+	// Cash without a target is fully invested.
+	plan, err := Calculate(positions, distributions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTransfers(t, plan.Transfers, []Transfer{
+		{Kind: Buy, From: CashName, To: "A fund", Amount: 100, Volume: 0.5},
+		{Kind: Buy, From: CashName, To: "B fund", Amount: 100, Volume: 0.5},
+	})
+
+	// Cash with a target is kept at it.
+	plan, err = Calculate(positions, distributions, WithCashTarget(0.25))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTransfers(t, plan.Transfers, []Transfer{
+		{Kind: Buy, From: CashName, To: "A fund", Amount: 50, Volume: 0.25},
+		{Kind: Buy, From: CashName, To: "B fund", Amount: 50, Volume: 0.25},
+	})
+}
+
+func TestCalculate_MatchByID(t *testing.T) {
+	positions := []Position{
+		{ID: "A", Instrument: Fund{BaseInstrument{ID: "1", Name: "A fund"}}, Value: Value{Value: 300.00}},
+		{ID: "B", Instrument: Fund{BaseInstrument{ISIN: "SE0000000002", Name: "B fund"}}, Value: Value{Value: 100.00}},
+		{ID: "C", Instrument: Fund{BaseInstrument{Name: "C fund"}}, Value: Value{Value: 0.00}},
+	}
+	distributions := []Distribution{
+		{InstrumentID: "1", InstrumentName: "A fund acc", Distribution: 0.5},
+		{ISIN: "SE0000000002", InstrumentName: "B", Distribution: 0.5},
+	}
+
+	plan, err := Calculate(positions, distributions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTransfers(t, plan.Transfers, []Transfer{
+		{From: "A fund", To: "B fund", Amount: 100, Volume: 1.0 / 3},
+	})
+	if want, got := []string{"C fund"}, plan.Unmatched; len(want) != len(got) || want[0] != got[0] {
+		t.Errorf("Unmatched = %v, want %v", got, want)
+	}
+
+	distributions = append(distributions, Distribution{InstrumentID: "4", InstrumentName: "D fund", Distribution: 0})
+	plan, err = Calculate(positions, distributions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := []string{"D fund", "C fund"}, plan.Unmatched; len(want) != len(got) || want[0] != got[0] || want[1] != got[1] {
+		t.Errorf("Unmatched = %v, want %v", got, want)
+	}
+}
+
+func TestCalculate_SameName(t *testing.T) {
+	positions := []Position{
+		{ID: "A", Instrument: Fund{BaseInstrument{ID: "1", Name: "Global"}}, Value: Value{Value: 300.00}},
+		{ID: "B", Instrument: Fund{BaseInstrument{ID: "2", Name: "Global"}}, Value: Value{Value: 100.00}},
+	}
+	distributions := []Distribution{
+		{InstrumentID: "1", InstrumentName: "Global", Distribution: 0.5},
+		{InstrumentID: "2", InstrumentName: "Global", Distribution: 0.5},
+	}
+
+	plan, err := Calculate(positions, distributions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTransfers(t, plan.Transfers, []Transfer{
+		{From: "Global (1)", To: "Global (2)", Amount: 100, Volume: 1.0 / 3},
+	})
+	if len(plan.Unmatched) > 0 || len(plan.DistributionProblems) > 0 {
+		t.Errorf("Unmatched = %v, DistributionProblems = %v, want none", plan.Unmatched, plan.DistributionProblems)
+	}
+}
+
+func TestCalculate_TransferCost(t *testing.T) {
+	positions := []Position{
+		{ID: "A", Instrument: Fund{BaseInstrument{Name: "A fund"}}, Value: Value{Value: 150.00}},
+		{ID: "B", Instrument: Fund{BaseInstrument{Name: "B fund"}}, Value: Value{Value: 150.00}},
+		{ID: "C", Instrument: Fund{BaseInstrument{Name: "C fund"}}, Value: Value{Value: 50.00}},
+		{ID: "D", Instrument: Fund{BaseInstrument{Name: "D fund"}}, Value: Value{Value: 50.00}},
+	}
+	distributions := []Distribution{
+		{InstrumentName: "A fund", Distribution: 0.25},
+		{InstrumentName: "B fund", Distribution: 0.25},
+		{InstrumentName: "C fund", Distribution: 0.25},
+		{InstrumentName: "D fund", Distribution: 0.25},
+	}
+
+	// Switches between A and D as well as between B and C are free.
+	free := map[[2]string]bool{{"A fund", "D fund"}: true, {"B fund", "C fund"}: true}
+	cost := func(from, to string) float64 {
+		if free[[2]string{from, to}] {
+			return 0
+		}
+		return 0.0025
+	}
+	plan, err := Calculate(positions, distributions, WithTransferCost(cost))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTransfers(t, plan.Transfers, []Transfer{
+		{From: "A fund", To: "D fund", Amount: 50, Volume: 50. / 150},
+		{From: "B fund", To: "C fund", Amount: 50, Volume: 50. / 150},
+	})
+
+	negative := func(from, to string) float64 { return -1 }
+	if _, err := Calculate(positions, distributions, WithTransferCost(negative)); !errors.Is(err, ErrTransferCost) {
+		t.Errorf("Calculate() error = %v, want %v", err, ErrTransferCost)
+	}
+}
+
+func TestCalculate_ManyInstruments(t *testing.T) {
+	const n = 300
+	positions := make([]Position, n)
+	distributions := make([]Distribution, n)
+	for i := range positions {
+		name := fmt.Sprintf("Fund %03d", i)
+		positions[i] = Position{
+			ID:         name,
+			Instrument: Fund{BaseInstrument{Name: name}},
+			Value:      Value{Value: float64(100 + (i*37)%200)},
+		}
+		distributions[i] = Distribution{InstrumentName: name, Distribution: 1. / n}
+	}
+	plan, err := Calculate(positions, distributions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	total := 0.0
+	for _, p := range positions {
+		total += p.Value.Value
+	}
+	for instr, got := range applyTransfers(positions, plan.Transfers) {
+		if want := total / n; math.Abs(want-got) > 1e-6 {
+			t.Errorf("value of %q = %v, want %v", instr, got, want)
+		}
+	}
+}
+
+func TestCalculate_NoDust(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for n := 0; n < 200; n++ {
+		var positions []Position
+		var distributions []Distribution
+		total := 0.0
+		for i := 0; i < 2+r.Intn(5); i++ {
+			name := fmt.Sprintf("%c fund", 'A'+i)
+			value := math.Round(r.Float64()*100000) / 100
+			total += value
+			positions = append(positions, Position{ID: name, Instrument: Fund{BaseInstrument{Name: name}}, Value: Value{Value: value}})
+			distributions = append(distributions, Distribution{InstrumentName: name, Distribution: r.Float64()})
+		}
+		amount := math.Round(r.Float64()*total*50) / 100
+		for _, opt := range []Option{WithDeposit(amount), WithWithdrawal(amount)} {
+			plan, err := Calculate(positions, distributions, opt, WithDistributionMode(DistributionNormalize))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, transfer := range plan.Transfers {
+				if transfer.Amount < dustTol*total {
+					t.Errorf("plan %d has transfer %+v of less than %g", n, transfer, dustTol*total)
+				}
+			}
+		}
+	}
+}
+
+func TestReadTransferCosts(t *testing.T) {
+	cost, err := ReadTransferCosts(strings.NewReader(`# from,to,cost
+*,*,0.0025
+A fund,B fund,0
+*,C fund,0.01
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		from, to string
+		want     float64
+	}{
+		{"A fund", "B fund", 0},
+		{"B fund", "A fund", 0.0025},
+		{"A fund", "C fund", 0.01},
+	} {
+		if got := cost(tt.from, tt.to); tt.want != got {
+			t.Errorf("cost(%q, %q) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+
+	if _, err := ReadTransferCosts(strings.NewReader("A fund,B fund,-1\n")); !errors.Is(err, ErrTransferCost) {
+		t.Errorf("ReadTransferCosts() error = %v, want %v", err, ErrTransferCost)
+	}
+}
+
+func TestCalculate_Constraints(t *testing.T) {
+	positions := []Position{
+		{ID: "A", Instrument: Fund{BaseInstrument{Name: "A fund"}}, Value: Value{Value: 150.00}},
+		{ID: "B", Instrument: Fund{BaseInstrument{Name: "B fund"}}, Value: Value{Value: 150.00}},
+		{ID: "C", Instrument: Fund{BaseInstrument{Name: "C fund"}}, Value: Value{Value: 0.00}},
+	}
+	distributions := []Distribution{
+		{InstrumentName: "A fund", Distribution: 1. / 3},
+		{InstrumentName: "B fund", Distribution: 1. / 3},
+		{InstrumentName: "C fund", Distribution: 1. / 3},
+	}
+
+	// B stays above its target since it may not be sold, while A and C are
+	// brought equally close to theirs.
+	plan, err := Calculate(positions, distributions, WithConstraints(map[string]Constraint{
+		"B fund": {Restriction: BuyOnly},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTransfers(t, plan.Transfers, []Transfer{
+		{From: "A fund", To: "C fund", Amount: 75, Volume: 75. / 150},
+	})
+
+	plan, err = Calculate(positions, distributions, WithConstraints(map[string]Constraint{
+		"C fund": {MaxWeight: 0.1},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := applyTransfers(positions, plan.Transfers)
+	if want, got := 30.0, values["C fund"]; math.Abs(want-got) > 1e-9 {
+		t.Errorf("value of C fund = %v, want %v", got, want)
+	}
+	if want, got := 30.0, transferredAmount(plan); math.Abs(want-got) > 1e-9 {
+		t.Errorf("transferred amount = %v, want %v", got, want)
+	}
+}
+
+func TestCalculate_WeightConstraints(t *testing.T) {
+	positions := []Position{
+		{ID: "A", Instrument: Fund{BaseInstrument{Name: "A fund"}}, Value: Value{Value: 400.00}},
+		{ID: "B", Instrument: Fund{BaseInstrument{Name: "B fund"}}, Value: Value{Value: 100.00}},
+		{ID: "C", Instrument: Fund{BaseInstrument{Name: "C fund"}}, Value: Value{Value: 100.00}},
+	}
+	distributions := []Distribution{
+		{InstrumentName: "A fund", Distribution: 1. / 3},
+		{InstrumentName: "B fund", Distribution: 1. / 3},
+		{InstrumentName: "C fund", Distribution: 1. / 3},
+	}
+
+	// A is kept from its target by its weight, and B and C are brought
+	// equally close to theirs, past them if need be.
+	for _, tt := range []struct {
+		constraint Constraint
+		want       float64
+	}{
+		{Constraint{MaxWeight: 0.30}, 180},
+		{Constraint{MaxWeight: 0.15}, 90},
+		{Constraint{MinWeight: 0.8}, 480},
+	} {
+		plan, err := Calculate(positions, distributions, WithConstraints(map[string]Constraint{"A fund": tt.constraint}))
+		if err != nil {
+			t.Fatalf("%v: %v", tt.constraint, err)
+		}
+		values := applyTransfers(positions, plan.Transfers)
+		for instr, want := range map[string]float64{
+			"A fund": tt.want,
+			"B fund": (600 - tt.want) / 2,
+			"C fund": (600 - tt.want) / 2,
+		} {
+			if got := values[instr]; math.Abs(want-got) > 1e-9 {
+				t.Errorf("%v: value of %s = %v, want %v", tt.constraint, instr, got, want)
+			}
+		}
+	}
+}
+
+func TestCalculate_InfeasibleConstraints(t *testing.T) {
+	positions := []Position{
+		{ID: "A", Instrument: Fund{BaseInstrument{Name: "A fund"}}, Value: Value{Value: 150.00}},
+		{ID: "B", Instrument: Fund{BaseInstrument{Name: "B fund"}}, Value: Value{Value: 150.00}},
+		{ID: "C", Instrument: Fund{BaseInstrument{Name: "C fund"}}, Value: Value{Value: 0.00}},
+	}
+	distributions := []Distribution{
+		{InstrumentName: "A fund", Distribution: 1. / 3},
+		{InstrumentName: "B fund", Distribution: 1. / 3},
+		{InstrumentName: "C fund", Distribution: 1. / 3},
+	}
+
+	for _, tt := range []struct {
+		constraints map[string]Constraint
+		culprits    []string
+	}{
+		{
+			constraints: map[string]Constraint{
+				"A fund": {Restriction: Locked, MaxWeight: 0.3},
+			},
+			culprits: []string{"A fund"},
+		},
+		{
+			constraints: map[string]Constraint{
+				"A fund": {MinWeight: 0.6},
+				"B fund": {MinWeight: 0.5},
+				"C fund": {Restriction: Locked},
+			},
+			culprits: []string{"A fund", "B fund"},
+		},
+	} {
+		_, err := Calculate(positions, distributions, WithConstraints(tt.constraints))
+		var cerr *ConstraintError
+		if !errors.As(err, &cerr) {
+			t.Fatalf("Calculate() error = %v, want a *ConstraintError", err)
+		}
+		if want, got := len(tt.culprits), len(cerr.Constraints); want != got {
+			t.Errorf("Calculate() error = %v, want constraints of %v", err, tt.culprits)
+		}
+		for _, instr := range tt.culprits {
+			if _, ok := cerr.Constraints[instr]; !ok {
+				t.Errorf("Calculate() error = %v, want constraints of %v", err, tt.culprits)
+			}
+		}
+	}
+
+	// The deposit is too small to transfer at all, with or without the
+	// constraint.
+	_, err := Calculate(positions, distributions, WithDeposit(50), WithMinTransfer(100),
+		WithConstraints(map[string]Constraint{"A fund": {Restriction: BuyOnly}}))
+	var cerr *ConstraintError
+	if !errors.Is(err, ErrInfeasible) || errors.As(err, &cerr) {
+		t.Errorf("Calculate() error = %v, want %v and no *ConstraintError", err, ErrInfeasible)
+	}
+
+	_, err = Calculate(positions, distributions, WithConstraints(map[string]Constraint{
+		"A fnud": {Restriction: Locked},
+	}))
+	if !errors.Is(err, ErrUnknownInstrument) {
+		t.Errorf("Calculate() error = %v, want %v", err, ErrUnknownInstrument)
+	}
+}
+
+func TestCalculate_Rounding(t *testing.T) {
+	positions := []Position{
+		{ID: "A", Instrument: Fund{BaseInstrument{Name: "A fund"}}, Value: Value{Value: 0.00}},
+		{ID: "B", Instrument: Fund{BaseInstrument{Name: "B fund"}}, Value: Value{Value: 150.00}},
+		{ID: "C", Instrument: Fund{BaseInstrument{Name: "C fund"}}, Value: Value{Value: 151.00}},
+	}
+	distributions := []Distribution{
+		{InstrumentName: "A fund", Distribution: 1. / 3},
+		{InstrumentName: "B fund", Distribution: 1. / 3},
+		{InstrumentName: "C fund", Distribution: 1. / 3},
+	}
+
+	for _, precision := range []int{0, 2} {
+		for i := range positions {
+			positions[i].Value.DecimalPrecision = precision
+		}
+		plan, err := Calculate(positions, distributions, WithRounding())
+		if err != nil {
+			t.Fatal(err)
+		}
+		unit := math.Pow10(-precision)
+		for _, tr := range plan.Transfers {
+			if units := tr.Amount / unit; math.Abs(units-math.Round(units)) > 1e-9 {
+				t.Errorf("precision %d: %v is not rounded", precision, tr)
+			}
+		}
+		for instr, got := range applyTransfers(positions, plan.Transfers) {
+			if want := 301. / 3; math.Abs(want-got) > unit {
+				t.Errorf("precision %d: value of %q = %v, want %v within %v", precision, instr, got, want, unit)
+			}
+		}
+	}
+}
+
+func TestCalculate_MinTransfer(t *testing.T) {
+	positions := []Position{
+		{ID: "A", Instrument: Fund{BaseInstrument{Name: "A fund"}}, Value: Value{Value: 95.00}},
+		{ID: "B", Instrument: Fund{BaseInstrument{Name: "B fund"}}, Value: Value{Value: 105.00}},
+		{ID: "C", Instrument: Fund{BaseInstrument{Name: "C fund"}}, Value: Value{Value: 80.00}},
+		{ID: "D", Instrument: Fund{BaseInstrument{Name: "D fund"}}, Value: Value{Value: 120.00}},
+	}
+	distributions := []Distribution{
+		{InstrumentName: "A fund", Distribution: 0.25},
+		{InstrumentName: "B fund", Distribution: 0.25},
+		{InstrumentName: "C fund", Distribution: 0.25},
+		{InstrumentName: "D fund", Distribution: 0.25},
+	}
+
+	plan, err := Calculate(positions, distributions, WithMinTransfer(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTransfers(t, plan.Transfers, []Transfer{
+		{From: "D fund", To: "C fund", Amount: 20, Volume: 20. / 120},
+	})
+}
+
+func TestCalculate_MinTransfer_ManyInstruments(t *testing.T) {
+	var positions []Position
+	var distributions []Distribution
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("Fund %02d", i)
+		positions = append(positions, Position{
+			ID:         name,
+			Instrument: Fund{BaseInstrument{Name: name}},
+			Value:      Value{Value: 100 + 1000*float64(i)/19},
+		})
+		distributions = append(distributions, Distribution{InstrumentName: name, Distribution: 1. / 20})
+	}
+
+	plan, err := Calculate(positions, distributions, WithMinTransfer(50))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tr := range plan.Transfers {
+		if tr.Amount < 50-1e-9 {
+			t.Errorf("%v is smaller than the minimum transfer", tr)
+		}
+	}
+	for instr, got := range applyTransfers(positions, plan.Transfers) {
+		if want := 600.; math.Abs(want-got) > 100 {
+			t.Errorf("value of %s = %v, want %v within %v", instr, got, want, 100)
+		}
+	}
+}
+
+// solverFunc is a solver that calls itself.
+type solverFunc func(p *problem) ([]float64, float64, lpStatus)
+
+func (f solverFunc) solve(p *problem) ([]float64, float64, lpStatus) {
+	return f(p)
+}
+
+func TestCalculate_SolverError(t *testing.T) {
+	positions := []Position{
+		{ID: "A", Instrument: Fund{BaseInstrument{Name: "A fund"}}, Value: Value{Value: 150.00}},
+		{ID: "B", Instrument: Fund{BaseInstrument{Name: "B fund"}}, Value: Value{Value: 50.00}},
+	}
+	distributions := []Distribution{
+		{InstrumentName: "A fund", Distribution: 0.5},
+		{InstrumentName: "B fund", Distribution: 0.5},
+	}
+
+	for _, tt := range []struct {
+		status lpStatus
+		want   error
+	}{
+		{status: lpInfeasible, want: ErrInfeasible},
+		{status: lpUnbounded, want: ErrUnbounded},
+		{status: lpIterationLimit, want: ErrIterationLimit},
+	} {
+		s := solverFunc(func(p *problem) ([]float64, float64, lpStatus) {
+			return nil, 0, tt.status
+		})
+		_, err := Calculate(positions, distributions, withSolver(s))
+		if !errors.Is(err, tt.want) {
+			t.Errorf("Calculate() error = %v, want %v", err, tt.want)
+		}
+		var serr *SolverError
+		if !errors.As(err, &serr) {
+			t.Fatalf("Calculate() error = %v, want a *SolverError", err)
+		}
+		if want := "x0_A_fund_B_fund"; !strings.Contains(serr.Model, want) {
+			t.Errorf("SolverError.Model = %q, want it to contain %q", serr.Model, want)
+		}
+	}
+
+	// A solver that claims that transferring nothing is optimal.
+	s := solverFunc(func(p *problem) ([]float64, float64, lpStatus) {
+		return make([]float64, len(p.obj)), 0, lpOptimal
+	})
+	_, err := Calculate(positions, distributions, withSolver(s))
+	var rerr *ResidualError
+	if !errors.As(err, &rerr) {
+		t.Fatalf("Calculate() error = %v, want a *ResidualError", err)
+	}
+	if want, got := 0.0, rerr.Got; want != got {
+		t.Errorf("ResidualError.Got = %v, want %v", got, want)
+	}
+}
+
+func TestValidateDistributions(t *testing.T) {
+	for _, tt := range []struct {
+		distributions []Distribution
+		want          []error
+	}{
+		{
+			distributions: []Distribution{
+				{InstrumentName: "A fund", Distribution: 0.5},
+				{InstrumentName: "B fund", Distribution: 0.5},
+			},
+		},
+		{
+			distributions: []Distribution{
+				{InstrumentName: "A fund", Distribution: 0.333},
+				{InstrumentName: "B fund", Distribution: 0.333},
+				{InstrumentName: "C fund", Distribution: 0.333},
+			},
+			want: []error{ErrTargetSum},
+		},
+		{
+			distributions: []Distribution{
+				{InstrumentName: "A fund", Distribution: 0.5},
+				{InstrumentName: "A fund", Distribution: 0.6},
+				{InstrumentName: "B fund", Distribution: -0.1},
+			},
+			want: []error{ErrDuplicateTarget, ErrNegativeTarget},
+		},
+	} {
+		problems := ValidateDistributions(tt.distributions)
+		if want, got := len(tt.want), len(problems); want != got {
+			t.Fatalf("ValidateDistributions(%v) = %v, want %v", tt.distributions, problems, tt.want)
+		}
+		for i, want := range tt.want {
+			if !errors.Is(problems[i], want) {
+				t.Errorf("ValidateDistributions(%v)[%d] = %v, want %v", tt.distributions, i, problems[i], want)
+			}
+		}
+	}
+}
+
+func TestCalculate_DistributionMode(t *testing.T) {
+	positions := []Position{
+		{ID: "A", Instrument: Fund{BaseInstrument{Name: "A fund"}}, Value: Value{Value: 100.00}},
+		{ID: "B", Instrument: Fund{BaseInstrument{Name: "B fund"}}, Value: Value{Value: 100.00}},
+	}
+	distributions := []Distribution{
+		{InstrumentName: "A fund", Distribution: 0.3},
+		{InstrumentName: "A fund", Distribution: 0.3},
+		{InstrumentName: "B fund", Distribution: 0.398},
+	}
+
+	plan, err := Calculate(positions, distributions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(plan.DistributionProblems); want != got {
+		t.Errorf("Plan.DistributionProblems = %v, want %d problems", plan.DistributionProblems, want)
+	}
+	// The duplicate targets are summed, as listed in the plan.
+	if want, got := 2, len(plan.Distributions); want != got {
+		t.Fatalf("Plan.Distributions = %v, want %d targets", plan.Distributions, want)
+	}
+	if want, got := 0.6, plan.Distributions[0].Distribution; want != got {
+		t.Errorf("target of %q = %v, want %v", plan.Distributions[0].InstrumentName, got, want)
+	}
+	// The targets sum to 0.998, so A and B are brought equally close to
+	// theirs.
+	assertTransfers(t, plan.Transfers, []Transfer{
+		{From: "B fund", To: "A fund", Amount: 20.2, Volume: 0.202},
+	})
+
+	_, err = Calculate(positions, distributions, WithDistributionMode(DistributionStrict))
+	if !errors.Is(err, ErrDuplicateTarget) || !errors.Is(err, ErrTargetSum) {
+		t.Errorf("Calculate() error = %v, want %v and %v", err, ErrDuplicateTarget, ErrTargetSum)
+	}
+
+	plan, err = Calculate(positions, distributions, WithDistributionMode(DistributionNormalize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(plan.Distributions); want != got {
+		t.Fatalf("Plan.Distributions = %v, want %d targets", plan.Distributions, want)
+	}
+	if want, got := 0.6/0.998*200-100, transferredAmount(plan); math.Abs(want-got) > 1e-9 {
+		t.Errorf("transferred amount = %v, want %v", got, want)
+	}
+
+	negative := append(distributions, Distribution{InstrumentName: "C fund", Distribution: -0.1})
+	_, err = Calculate(positions, negative, WithDistributionMode(DistributionNormalize))
+	if !errors.Is(err, ErrNegativeTarget) {
+		t.Errorf("Calculate() error = %v, want %v", err, ErrNegativeTarget)
+	}
+}
+
+func TestValidatePositions(t *testing.T) {
+	positions := []Position{
+		{ID: "A", Instrument: Fund{BaseInstrument{Name: "A fund", Currency: "SEK"}}, Value: Value{Value: 100.00, Unit: "SEK"}},
+		{ID: "B", Instrument: Fund{BaseInstrument{Name: "B fund", Currency: "SEK"}}, Value: Value{Value: 100.00, Unit: "SEK"}},
+		{ID: "C", Instrument: Fund{BaseInstrument{Name: "C fund", Currency: "USD"}}, Value: Value{Value: 100.00, Unit: "SEK"}},
+		{ID: "D", Instrument: Fund{BaseInstrument{Name: "A fund", Currency: "SEK"}}, Value: Value{Value: -5.00, Unit: "SEK"}},
+	}
+
+	report := ValidatePositions(positions)
+	if report == nil {
+		t.Fatal("ValidatePositions() = nil, want a report")
+	}
+	want := []PositionProblem{
+		{PositionID: "C", Instrument: "C fund", Field: "Instrument.Currency", Expected: "SEK", Actual: "USD", Err: ErrCurrency},
+		{PositionID: "D", Instrument: "A fund", Field: "Value.Value", Expected: "at least 0", Actual: "-5", Err: ErrNegativeValue},
+		{PositionID: "D", Instrument: "A fund", Field: "Instrument.Name", Expected: "unique", Actual: "A fund", Err: ErrDuplicateInstrument},
+	}
+	if want, got := len(want), len(report.Problems); want != got {
+		t.Fatalf("ValidatePositions() = %v, want %d problems", report, want)
+	}
+	for i := range want {
+		if want, got := want[i], report.Problems[i]; want != got {
+			t.Errorf("ValidatePositions().Problems[%d] = %+v, want %+v", i, got, want)
+		}
+	}
+
+	_, err := Calculate(positions, []Distribution{{InstrumentName: "A fund", Distribution: 1}})
+	if !errors.Is(err, ErrCurrency) {
+		t.Errorf("Calculate() error = %v, want %v", err, ErrCurrency)
+	}
+
+	if report := ValidatePositions(positions[:2]); report != nil {
+		t.Errorf("ValidatePositions() = %v, want nil", report)
+	}
+}
+
+func TestReadRates(t *testing.T) {
+	rates, err := ReadRates(strings.NewReader("# from,to,rate\nUSD,SEK,10\nEUR,SEK,11.5\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		from, to string
+		want     float64
+	}{
+		{"USD", "SEK", 10},
+		{"SEK", "USD", 0.1},
+		{"SEK", "SEK", 1},
+		{"EUR", "SEK", 11.5},
+	} {
+		got, err := rates.Rate(tt.from, tt.to)
+		if err != nil {
+			t.Errorf("Rate(%q, %q) error = %v", tt.from, tt.to, err)
+		} else if math.Abs(tt.want-got) > 1e-12 {
+			t.Errorf("Rate(%q, %q) = %v, want %v", tt.from, tt.to, got, tt.want)
+		}
+	}
+	if _, err := rates.Rate("USD", "EUR"); !errors.Is(err, ErrNoRate) {
+		t.Errorf("Rate() error = %v, want %v", err, ErrNoRate)
+	}
+
+	if _, err := ReadRates(strings.NewReader("USD,SEK,-1\n")); err == nil {
+		t.Error("ReadRates() error = nil, want error for a negative rate")
+	}
+}
+
+func TestCalculate_BaseCurrency(t *testing.T) {
+	positions := []Position{
+		{ID: "A", Instrument: Fund{BaseInstrument{Name: "A fund", Currency: "USD"}}, Value: Value{Value: 10.00, Unit: "USD"}},
+		{ID: "B", Instrument: Fund{BaseInstrument{Name: "B fund", Currency: "SEK"}}, Value: Value{Value: 300.00, Unit: "SEK"}},
+	}
+	distributions := []Distribution{
+		{InstrumentName: "A fund", Distribution: 0.5},
+		{InstrumentName: "B fund", Distribution: 0.5},
+	}
+
+	if _, err := Calculate(positions, distributions); !errors.Is(err, ErrCurrency) {
+		t.Errorf("Calculate() error = %v, want %v", err, ErrCurrency)
+	}
+
+	plan, err := Calculate(positions, distributions, WithBaseCurrency("SEK", Rates{{"USD", "SEK"}: 10}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTransfers(t, plan.Transfers, []Transfer{
+		{From: "B fund", To: "A fund", Amount: 100, Volume: 1. / 3},
+	})
+	if tr := plan.Transfers[0]; math.Abs(tr.FromAmount-100) > 1e-9 || tr.FromCurrency != "SEK" ||
+		math.Abs(tr.ToAmount-10) > 1e-9 || tr.ToCurrency != "USD" {
+		t.Errorf("transfer = %+v, want 100 SEK from B fund and 10 USD to A fund", tr)
+	}
+
+	if _, err := Calculate(positions, distributions, WithBaseCurrency("EUR", Rates{{"USD", "SEK"}: 10})); !errors.Is(err, ErrNoRate) {
+		t.Errorf("Calculate() error = %v, want %v", err, ErrNoRate)
+	}
+}
+
+func TestCalculate_Accounts(t *testing.T) {
+	isk, kf := Account{ID: "1", Name: "ISK"}, Account{ID: "2", Name: "KF"}
+	positions := []Position{
+		{ID: "A1", Account: isk, Instrument: Fund{BaseInstrument{Name: "A fund"}}, Value: Value{Value: 100.00}},
+		{ID: "B1", Account: isk, Instrument: Fund{BaseInstrument{Name: "B fund"}}, Value: Value{Value: 100.00}},
+		{ID: "A2", Account: kf, Instrument: Fund{BaseInstrument{Name: "A fund"}}, Value: Value{Value: 200.00}},
+	}
+	distributions := []Distribution{
+		{InstrumentName: "A fund", Distribution: 0.25},
+		{InstrumentName: "B fund", Distribution: 0.25},
+		{InstrumentName: "C fund", Distribution: 0.5},
+	}
+
+	// A fund is 200 over its target in total, of which the ISK account
+	// only holds 100, so at least 100 is to be sold in the KF account.
+	plan, err := Calculate(positions, distributions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sold := map[string]float64{}
+	for _, tr := range plan.Transfers {
+		if tr.From != "A fund" || tr.To != "C fund" {
+			t.Errorf("transfer %v, want from A fund to C fund", tr)
+		}
+		sold[tr.Account] += tr.Amount
+	}
+	if sold[isk.ID] > 100+1e-9 || sold[kf.ID] > 200+1e-9 {
+		t.Errorf("sold %v in ISK and %v in KF, want at most what they hold", sold[isk.ID], sold[kf.ID])
+	}
+	if want, got := 200.0, sold[isk.ID]+sold[kf.ID]; math.Abs(want-got) > 1e-9 {
+		t.Errorf("sold in total = %v, want %v", got, want)
+	}
+	for _, tr := range plan.Transfers {
+		if want, got := tr.Amount/map[string]float64{isk.ID: 100, kf.ID: 200}[tr.Account], tr.Volume; math.Abs(want-got) > 1e-9 {
+			t.Errorf("transfer %v volume = %v, want %v", tr, got, want)
+		}
+	}
+
+	// Rounding holds within each account too.
+	plan, err = Calculate(positions, append(distributions[:2:2], Distribution{InstrumentName: "C fund", Distribution: 0.4999}), WithRounding())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tr := range plan.Transfers {
+		if tr.Amount != math.Round(tr.Amount) {
+			t.Errorf("transfer %v, want a whole amount", tr)
+		}
+	}
+}
+
+func TestCalculate_AccountsRoundingCount(t *testing.T) {
+	values := [][]float64{
+		{526671.01, 391807.26, 0, 0, 873773.24, 585980.79},
+		{656340.66, 105852.19, 0, 358892.68, 933222.34, 796837.83},
+		{520076.98, 998562.12, 726111.88, 766671.73, 914163.56, 0},
+	}
+	weights := []float64{0.3, 0.25, 0.2, 0.1, 0.1, 0.05}
+	var positions []Position
+	total := 0.0
+	for a, row := range values {
+		for i, v := range row {
+			if v == 0 {
+				continue
+			}
+			positions = append(positions, Position{
+				Account:    Account{ID: fmt.Sprint(a + 1)},
+				Instrument: Fund{BaseInstrument{Name: fmt.Sprintf("%c fund", 'A'+i)}},
+				Value:      Value{Value: v, DecimalPrecision: 2},
+			})
+			total += v
+		}
+	}
+	var distributions []Distribution
+	for i, w := range weights {
+		distributions = append(distributions, Distribution{InstrumentName: fmt.Sprintf("%c fund", 'A'+i), Distribution: w})
+	}
+
+	plan, err := Calculate(positions, distributions, WithRounding(), WithObjective(MinimizeCount))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sold := map[string]float64{}
+	for _, tr := range plan.Transfers {
+		if cents := tr.Amount * 100; math.Abs(cents-math.Round(cents)) > 1e-6 {
+			t.Errorf("transfer %v, want a whole amount of cents", tr)
+		}
+		sold[tr.Account+"/"+tr.From] += tr.Amount
+		sold[tr.Account+"/"+tr.To] -= tr.Amount
+	}
+	for _, pos := range positions {
+		if got := sold[pos.Account.ID+"/"+pos.Instrument.Name]; got > pos.Value.Value+1e-6 {
+			t.Errorf("sold %v of %v in account %s, want at most what it holds", got, pos.Instrument.Name, pos.Account.ID)
+		}
+	}
+	after := applyTransfers(positions, plan.Transfers)
+	for i, w := range weights {
+		instr := fmt.Sprintf("%c fund", 'A'+i)
+		if got := after[instr]; math.Abs(w*total-got) > 0.01+1e-6 {
+			t.Errorf("value of %s = %v, want %v within 0.01", instr, got, w*total)
+		}
+	}
+}
+
+func TestReadLocationCosts(t *testing.T) {
+	cost, err := ReadLocationCosts(strings.NewReader(`# account type,instrument,cost
+ISK,bonds,0.01
+*,bonds,0.005
+TJP,*,inf
+TJP,A fund,0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		accountType, instrument, assetClass string
+		want                                float64
+	}{
+		{"ISK", "B fund", "bonds", 0.01},
+		{"KF", "B fund", "bonds", 0.005},
+		{"ISK", "E fund", "bonds/short", 0.01},
+		{"KF", "C fund", "", 0},
+		{"TJP", "A fund", "equities", 0},
+		{"TJP", "B fund", "bonds", math.Inf(1)},
+	} {
+		if got := cost(tt.accountType, tt.instrument, tt.assetClass); tt.want != got {
+			t.Errorf("cost(%q, %q, %q) = %v, want %v", tt.accountType, tt.instrument, tt.assetClass, got, tt.want)
+		}
+	}
+
+	if _, err := ReadLocationCosts(strings.NewReader("ISK,bonds,-1\n")); !errors.Is(err, ErrLocationCost) {
+		t.Errorf("ReadLocationCosts() error = %v, want %v", err, ErrLocationCost)
+	}
+}
+
+func TestCalculate_LocationCost(t *testing.T) {
+	isk, kf := Account{ID: "1", Type: "ISK"}, Account{ID: "2", Type: "KF"}
+	positions := []Position{
+		{ID: "A1", Account: isk, Instrument: Fund{BaseInstrument{Name: "A fund"}}, Value: Value{Value: 100.00}},
+		{ID: "B1", Account: isk, Instrument: Fund{BaseInstrument{Name: "B fund"}}, Value: Value{Value: 100.00}},
+		{ID: "A2", Account: kf, Instrument: Fund{BaseInstrument{Name: "A fund"}}, Value: Value{Value: 100.00}},
+		{ID: "B2", Account: kf, Instrument: Fund{BaseInstrument{Name: "B fund"}}, Value: Value{Value: 100.00}},
+	}
+	distributions := []Distribution{
+		{InstrumentName: "A fund", Distribution: 0.5, AssetClass: "equities"},
+		{InstrumentName: "B fund", Distribution: 0.5, AssetClass: "bonds"},
+	}
+	cost := func(accountType, instrument, assetClass string) float64 {
+		if accountType == "ISK" && assetClass == "bonds" || accountType == "KF" && assetClass == "equities" {
+			return 0.01
+		}
+		return 0
+	}
+
+	// The targets are already reached, but the bonds are cheaper to hold
+	// in the KF account and the equities in the ISK account.
+	plan, err := Calculate(positions, distributions, WithLocationCost(cost))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTransfers(t, plan.Transfers, []Transfer{
+		{Account: isk.ID, From: "B fund", To: "A fund", Amount: 100.00, Volume: 1},
+		{Account: kf.ID, From: "A fund", To: "B fund", Amount: 100.00, Volume: 1},
+	})
+
+	// Unless transferring costs more than holding them where they are.
+	transferCost := func(from, to string) float64 { return 0.02 }
+	plan, err = Calculate(positions, distributions, WithLocationCost(cost), WithTransferCost(transferCost))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTransfers(t, plan.Transfers, nil)
+
+	// Bonds may not be bought in the pension account, even though it
+	// already holds some.
+	tjp := Account{ID: "3", Type: "TJP"}
+	positions = []Position{
+		{ID: "A1", Account: isk, Instrument: Fund{BaseInstrument{Name: "A fund"}}, Value: Value{Value: 200.00}},
+		{ID: "A3", Account: tjp, Instrument: Fund{BaseInstrument{Name: "A fund"}}, Value: Value{Value: 100.00}},
+		{ID: "B3", Account: tjp, Instrument: Fund{BaseInstrument{Name: "B fund"}}, Value: Value{Value: 100.00}},
+	}
+	cost = func(accountType, instrument, assetClass string) float64 {
+		if accountType == "TJP" && assetClass == "bonds" {
+			return math.Inf(1)
+		}
+		return 0
+	}
+	plan, err = Calculate(positions, distributions, WithLocationCost(cost))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertTransfers(t, plan.Transfers, []Transfer{
+		{Account: isk.ID, From: "A fund", To: "B fund", Amount: 100.00, Volume: 0.5},
+	})
+}
+
+func TestCalculate_AssetClasses(t *testing.T) {
+	positions := []Position{
+		{ID: "A", Instrument: Fund{BaseInstrument{Name: "A fund"}}, Value: Value{Value: 400.00}},
+		{ID: "B", Instrument: Fund{BaseInstrument{Name: "B fund"}}, Value: Value{Value: 100.00}},
+		{ID: "C", Instrument: Fund{BaseInstrument{Name: "C fund"}}, Value: Value{Value: 100.00}},
+		{ID: "D", Instrument: Fund{BaseInstrument{Name: "D fund"}}, Value: Value{Value: 400.00}},
+	}
+	distributions := []Distribution{
+		{InstrumentName: "A fund", Distribution: 2, AssetClass: "equities/global"},
+		{InstrumentName: "B fund", Distribution: 1, AssetClass: "equities/global"},
+		{InstrumentName: "C fund", AssetClass: "equities/sweden"},
+		{InstrumentName: "D fund", AssetClass: "fixed income"},
+	}
+	classes := []AssetClass{
+		{Name: "equities", Weight: 0.6, Classes: []AssetClass{
+			{Name: "global", Weight: 0.7},
+			{Name: "sweden", Weight: 0.3},
+		}},
+		{Name: "fixed income", Weight: 0.4},
+	}
+
+	plan, err := Calculate(positions, distributions, WithAssetClasses(classes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []float64{0.28, 0.14, 0.18, 0.4} {
+		if got := plan.Distributions[i].Distribution; math.Abs(want-got) > 1e-9 {
+			t.Errorf("%s target = %v, want %v", plan.Distributions[i].InstrumentName, got, want)
+		}
+	}
+	for i, want := range []ClassDeviation{
+		{Class: "equities", Level: 0, Amount: 0},
+		{Class: "equities/global", Level: 1, Amount: 80},
+		{Class: "equities/sweden", Level: 1, Amount: -80},
+		{Class: "fixed income", Level: 0, Amount: 0},
+	} {
+		got := plan.ClassDeviations[i]
+		if want.Class != got.Class || want.Level != got.Level || math.Abs(want.Amount-got.Amount) > 1e-9 {
+			t.Errorf("ClassDeviations[%d] = %v, want %v", i, got, want)
+		}
+	}
+
+	distributions[3].AssetClass = "bonds"
+	if _, err := Calculate(positions, distributions, WithAssetClasses(classes)); !errors.Is(err, ErrAssetClass) {
+		t.Errorf("Calculate() error = %v, want %v", err, ErrAssetClass)
+	}
+}
+
+func TestCalculate_AssetClassRebalancing(t *testing.T) {
+	distributions := []Distribution{
+		{InstrumentName: "A fund", Distribution: 1, AssetClass: "equities"},
+		{InstrumentName: "B fund", Distribution: 1, AssetClass: "equities"},
+		{InstrumentName: "C fund", Distribution: 1, AssetClass: "bonds"},
+	}
+	classes := []AssetClass{
+		{Name: "equities", Weight: 0.6},
+		{Name: "bonds", Weight: 0.4},
+	}
+	positions := func(a, b, c float64) []Position {
+		return []Position{
+			{ID: "A", Instrument: Fund{BaseInstrument{Name: "A fund"}}, Value: Value{Value: a}},
+			{ID: "B", Instrument: Fund{BaseInstrument{Name: "B fund"}}, Value: Value{Value: b}},
+			{ID: "C", Instrument: Fund{BaseInstrument{Name: "C fund"}}, Value: Value{Value: c}},
+		}
+	}
+
+	for _, tc := range []struct {
+		name      string
+		positions []Position
+		classes   []AssetClass
+		opts      []Option
+		want      []Transfer
+	}{
+		{
+			// The equities are on target, even though their
+			// instruments are not.
+			name:      "class on target",
+			positions: positions(400, 200, 400),
+		},
+		{
+			name:      "class on target, rounding",
+			positions: positions(400, 200, 400),
+			opts:      []Option{WithRounding()},
+		},
+		{
+			// Only the equities above their target are sold.
+			name:      "class off target",
+			positions: positions(500, 200, 300),
+			want: []Transfer{
+				{From: "A fund", To: "C fund", Amount: 100, Volume: 0.2},
+			},
+		},
+		{
+			name:      "class off target, rounding",
+			positions: positions(500, 200, 300),
+			opts:      []Option{WithRounding()},
+			want: []Transfer{
+				{From: "A fund", To: "C fund", Amount: 100, Volume: 0.2},
+			},
+		},
+		{
+			name:      "class within band",
+			positions: positions(520, 120, 360),
+			classes: []AssetClass{
+				{Name: "equities", Weight: 0.6, Tolerance: &Tolerance{Absolute: 0.05}},
+				{Name: "bonds", Weight: 0.4, Tolerance: &Tolerance{Relative: 0.15}},
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			classes := classes
+			if tc.classes != nil {
+				classes = tc.classes
+			}
+			plan, err := Calculate(tc.positions, distributions, append(tc.opts, WithAssetClasses(classes))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertTransfers(t, plan.Transfers, tc.want)
+		})
+	}
+}
@@ -0,0 +1,167 @@
+package transfers
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Problems that may be found with positions.
+var (
+	ErrCurrency            = errors.New("currency differs")
+	ErrUnit                = errors.New("unit differs")
+	ErrUnitType            = errors.New("unit type differs")
+	ErrNegativeValue       = errors.New("negative value")
+	ErrDuplicateInstrument = errors.New("duplicate instrument")
+)
+
+// PositionProblem is a problem with a field of a position.
+type PositionProblem struct {
+	PositionID string
+	Instrument string
+	// Field is the name of the field, e.g. "Instrument.Currency".
+	Field    string
+	Expected string
+	Actual   string
+	// Err is the kind of problem, e.g. ErrCurrency.
+	Err error
+}
+
+func (p PositionProblem) Error() string {
+	position := fmt.Sprintf("%q", p.Instrument)
+	if p.PositionID != "" {
+		position = fmt.Sprintf("%q (%s)", p.PositionID, p.Instrument)
+	}
+	return fmt.Sprintf("%v: %s of position %s is %q, expected %q", p.Err, p.Field, position, p.Actual, p.Expected)
+}
+
+func (p PositionProblem) Unwrap() error {
+	return p.Err
+}
+
+// ValidationReport lists the problems found with a set of positions.
+type ValidationReport struct {
+	Problems []PositionProblem
+}
+
+func (r *ValidationReport) Error() string {
+	problems := make([]string, len(r.Problems))
+	for i, p := range r.Problems {
+		problems[i] = p.Error()
+	}
+	return "invalid positions: " + strings.Join(problems, "; ")
+}
+
+// Is reports whether any of the problems is target.
+func (r *ValidationReport) Is(target error) bool {
+	for _, p := range r.Problems {
+		if errors.Is(p, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// without returns the report without the problems of the given kind, or nil
+// if there are no other problems.
+func (r *ValidationReport) without(err error) *ValidationReport {
+	var problems []PositionProblem
+	for _, p := range r.Problems {
+		if !errors.Is(p, err) {
+			problems = append(problems, p)
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return &ValidationReport{Problems: problems}
+}
+
+// ValidatePositions checks that the positions agree on currency, unit and unit
+// type, that none of them has a negative value and that no instrument is held
+// in more than one of them per account. What the positions are expected to agree on is
+// what most of them do. It returns nil if no problems are found.
+func ValidatePositions(positions []Position) *ValidationReport {
+	v := newPositionVerifier(positions)
+	for _, p := range positions {
+		v.inspect(p)
+	}
+	return v.report()
+}
+
+// positionField is a field of a position that all positions should agree on.
+type positionField struct {
+	name  string
+	value func(Position) string
+	err   error
+}
+
+var positionFields = []positionField{
+	{"Instrument.Currency", func(p Position) string { return p.Instrument.Currency }, ErrCurrency},
+	{"Value.Unit", func(p Position) string { return p.Value.Unit }, ErrUnit},
+	{"Value.UnitType", func(p Position) string { return p.Value.UnitType }, ErrUnitType},
+}
+
+type positionVerifier struct {
+	// The most common value of each of the positionFields
+	expected []string
+	// The instruments held per account
+	instruments map[[2]string]bool
+
+	problems []PositionProblem
+}
+
+// newPositionVerifier creates a positionVerifier that expects the most common
+// value of each field among the given positions.
+func newPositionVerifier(positions []Position) *positionVerifier {
+	v := &positionVerifier{
+		expected:    make([]string, len(positionFields)),
+		instruments: map[[2]string]bool{},
+	}
+	for i, field := range positionFields {
+		counts, most := map[string]int{}, 0
+		for _, p := range positions {
+			value := field.value(p)
+			counts[value]++
+			if counts[value] > most {
+				v.expected[i], most = value, counts[value]
+			}
+		}
+	}
+	return v
+}
+
+func (v *positionVerifier) inspect(p Position) {
+	problem := func(field, expected, actual string, err error) {
+		v.problems = append(v.problems, PositionProblem{
+			PositionID: p.ID,
+			Instrument: p.Instrument.Name,
+			Field:      field,
+			Expected:   expected,
+			Actual:     actual,
+			Err:        err,
+		})
+	}
+
+	for i, field := range positionFields {
+		if actual := field.value(p); actual != v.expected[i] {
+			problem(field.name, v.expected[i], actual, field.err)
+		}
+	}
+	if p.Value.Value < 0 {
+		problem("Value.Value", "at least 0", strconv.FormatFloat(p.Value.Value, 'f', -1, 64), ErrNegativeValue)
+	}
+	holding := [2]string{p.Account.ID, p.Instrument.Name}
+	if v.instruments[holding] {
+		problem("Instrument.Name", "unique", p.Instrument.Name, ErrDuplicateInstrument)
+	}
+	v.instruments[holding] = true
+}
+
+func (v *positionVerifier) report() *ValidationReport {
+	if len(v.problems) == 0 {
+		return nil
+	}
+	return &ValidationReport{Problems: v.problems}
+}